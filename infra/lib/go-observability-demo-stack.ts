@@ -6,6 +6,7 @@ import * as ecs_patterns from "aws-cdk-lib/aws-ecs-patterns";
 import * as rds from "aws-cdk-lib/aws-rds";
 import * as logs from "aws-cdk-lib/aws-logs";
 import * as iam from "aws-cdk-lib/aws-iam";
+import * as secretsmanager from "aws-cdk-lib/aws-secretsmanager";
 import { Construct } from "constructs";
 
 const awsOtelCollectorConfig = `
@@ -89,6 +90,10 @@ processors:
 exporters:
   awsxray:
     indexed_attributes: ["otel.resource.aws.ecs.cluster.arn"]
+  awsemf:
+    namespace: GoObservabilityDemo/OTel
+    log_group_name: /ecs/go-observability-demo/otel-metrics
+    dimension_rollup_option: NoDimensionRollup
 
 service:
   pipelines:
@@ -96,6 +101,10 @@ service:
       receivers: [otlp]
       processors: [resourcedetection, batch/traces]
       exporters: [awsxray]
+    metrics:
+      receivers: [otlp]
+      processors: [resourcedetection, resource, batch/metrics]
+      exporters: [awsemf]
 
   extensions: [health_check]
 
@@ -131,6 +140,15 @@ export class GoObservabilityDemoStack extends cdk.Stack {
       deleteAutomatedBackups: true,
     });
 
+    // Salt of the PII_REDACTION=hash policy
+    const piiRedactionSalt = new secretsmanager.Secret(this, "PiiRedactionSalt", {
+      description: "HMAC key for hashing user names in logs, traces and metrics",
+      generateSecretString: {
+        passwordLength: 32,
+        excludePunctuation: true,
+      },
+    });
+
     // ECS Cluster
     const cluster = new ecs.Cluster(this, "Cluster", {
       vpc,
@@ -206,12 +224,15 @@ export class GoObservabilityDemoStack extends cdk.Stack {
             OTEL_EXPORTER_OTLP_ENDPOINT: "http://localhost:4318",
             OTEL_TRACES_SAMPLER: "parentbased_traceidratio",
             OTEL_TRACES_SAMPLER_ARG: "1",
+            TRACE_XRAY: "true",
           },
           secrets: {
             DB_PASSWORD: ecs.Secret.fromSecretsManager(
               database.secret!,
               "password"
             ),
+            PII_REDACTION_SALT:
+              ecs.Secret.fromSecretsManager(piiRedactionSalt),
           },
           logDriver: ecs.LogDrivers.awsLogs({
             streamPrefix: "go-observability-demo",
@@ -228,7 +249,7 @@ export class GoObservabilityDemoStack extends cdk.Stack {
     );
 
     service.targetGroup.configureHealthCheck({
-      path: "/health",
+      path: "/readyz",
       healthyHttpCodes: "200",
       interval: cdk.Duration.seconds(30),
       timeout: cdk.Duration.seconds(5),
@@ -265,6 +286,7 @@ export class GoObservabilityDemoStack extends cdk.Stack {
     // Allow ECS service to connect to RDS
     database.connections.allowFrom(service.service, ec2.Port.tcp(5432));
     database.secret?.grantRead(service.taskDefinition.taskRole);
+    piiRedactionSalt.grantRead(service.taskDefinition.taskRole);
 
     // CloudWatch Dashboard
     const dashboard = new cdk.aws_cloudwatch.Dashboard(this, "Dashboard", {
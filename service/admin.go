@@ -0,0 +1,37 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// adminMiddleware only lets trusted callers reach the admin endpoints, which
+// change how the service logs and expose its internals
+func (app *App) adminMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !app.trustedCaller(r) {
+			app.returnErrorResponse(w, r, "Admin endpoint refused", ForbiddenError(errors.New("a valid admin token is required")))
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// trustedCaller reports whether r may use the admin endpoints and per-request
+// debug logging. With an admin token configured the request must carry it as
+// a bearer token; without one only loopback callers, such as a shell in the
+// container, are trusted. Requests forwarded by a proxy are never loopback.
+func (app *App) trustedCaller(r *http.Request) bool {
+	if app.adminToken != "" {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		return ok && subtle.ConstantTimeCompare([]byte(token), []byte(app.adminToken)) == 1
+	}
+
+	host, _ := splitHostPort(r.RemoteAddr)
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback() && r.Header.Get("X-Forwarded-For") == ""
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func TestAdminEndpointsRequireTrustedCaller(t *testing.T) {
+	tests := []struct {
+		name       string
+		token      string
+		remoteAddr string
+		header     http.Header
+		wantStatus int
+	}{
+		{name: "remote caller without token configured", remoteAddr: "192.0.2.1:4000", wantStatus: http.StatusForbidden},
+		{name: "loopback caller without token configured", remoteAddr: "127.0.0.1:4000", wantStatus: http.StatusOK},
+		{name: "forwarded through a proxy on loopback", remoteAddr: "127.0.0.1:4000", header: http.Header{"X-Forwarded-For": {"198.51.100.7"}}, wantStatus: http.StatusForbidden},
+		{name: "loopback caller without the configured token", token: "secret", remoteAddr: "127.0.0.1:4000", wantStatus: http.StatusForbidden},
+		{name: "wrong token", token: "secret", remoteAddr: "192.0.2.1:4000", header: http.Header{"Authorization": {"Bearer guess"}}, wantStatus: http.StatusForbidden},
+		{name: "valid token", token: "secret", remoteAddr: "192.0.2.1:4000", header: http.Header{"Authorization": {"Bearer secret"}}, wantStatus: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t)
+			app.adminToken = tt.token
+
+			r := httptest.NewRequest(http.MethodPut, "/admin/log-level", strings.NewReader(`{"level": "DEBUG"}`))
+			r.RemoteAddr = tt.remoteAddr
+			for key, values := range tt.header {
+				r.Header[key] = values
+			}
+
+			w := app.serve(r)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if changed := app.logLevel.Level() == slog.LevelDebug; changed != (tt.wantStatus == http.StatusOK) {
+				t.Errorf("log level changed = %v for status %d", changed, w.Code)
+			}
+		})
+	}
+}
+
+func TestDebugHeaderOnlyHonoredForTrustedCallers(t *testing.T) {
+	for _, trusted := range []bool{false, true} {
+		app := newTestApp(t)
+		app.adminToken = "secret"
+		router := chi.NewRouter()
+		router.Use(app.observabilityMiddleware)
+		router.Get("/coffee/1", func(w http.ResponseWriter, r *http.Request) {
+			app.logger.DebugContext(r.Context(), "Debug probe")
+		})
+
+		r := httptest.NewRequest(http.MethodGet, "/coffee/1", nil)
+		r.Header.Set("X-Debug", "1")
+		if trusted {
+			r.Header.Set("Authorization", "Bearer secret")
+		}
+		router.ServeHTTP(httptest.NewRecorder(), r)
+
+		debugLogged := false
+		for _, line := range app.logLines(t) {
+			if line["msg"] == "Debug probe" {
+				debugLogged = true
+			}
+		}
+		if debugLogged != trusted {
+			t.Errorf("trusted = %v: debug record logged = %v", trusted, debugLogged)
+		}
+	}
+}
+
+func TestPoolStatsRequireTrustedCaller(t *testing.T) {
+	app := newTestApp(t)
+	app.adminToken = "secret"
+
+	w := app.serve(httptest.NewRequest(http.MethodGet, "/debug/pool", nil))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("status = %d, want 403", w.Code)
+	}
+}
@@ -3,100 +3,286 @@ package main
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"log/slog"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/go-chi/chi/v5"
+	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/trace"
 )
 
 // App represents the application instance
 type App struct {
-	db      *Database
-	logger  *slog.Logger
-	metrics *CloudWatchMetrics
-	region  string
-	tracer  trace.Tracer
+	// db is only used for the pool statistics; order data goes through orders
+	db     *Database
+	orders OrderRepository
+	health *HealthRegistry
+	limits *requestLimits
+	// adminToken guards the admin endpoints and debug logging; empty trusts loopback callers only
+	adminToken string
+	logger     *slog.Logger
+	logLevel   *slog.LevelVar
+	metrics    *Metrics
+	redactor   *Redactor
+	region     string
+	tracer     trace.Tracer
+	xray       bool
 }
 
 // Response writer wrapper
 type responseWriter struct {
 	http.ResponseWriter
-	statusCode int
+	statusCode   int
+	bytesWritten int
+	wroteHeader  bool
+}
+
+func (rw *responseWriter) Write(b []byte) (int, error) {
+	rw.wroteHeader = true
+	n, err := rw.ResponseWriter.Write(b)
+	rw.bytesWritten += n
+	return n, err
+}
+
+// wrapResponseWriter returns w if it already is a responseWriter, so every
+// middleware in the chain reads the status code from the same wrapper
+func wrapResponseWriter(w http.ResponseWriter) *responseWriter {
+	if wrapped, ok := w.(*responseWriter); ok {
+		return wrapped
+	}
+	return &responseWriter{ResponseWriter: w, statusCode: http.StatusOK}
 }
 
 func (rw *responseWriter) WriteHeader(code int) {
 	rw.statusCode = code
+	rw.wroteHeader = true
 	rw.ResponseWriter.WriteHeader(code)
 }
 
-func (app *App) healthHandler(w http.ResponseWriter, r *http.Request) {
-	// Check database connectivity
-	ctx := r.Context()
+// livenessHandler reports that the process is running and serving HTTP. It
+// checks no dependencies, so a database outage never restarts the task.
+func (app *App) livenessHandler(w http.ResponseWriter, r *http.Request) {
+	app.writeHealthResponse(w, HealthResponse{Status: HealthPass, Timestamp: time.Now()})
+}
+
+// readinessHandler runs the registered health checks and responds 503 when a
+// critical dependency is down or the service is shutting down, so the load
+// balancer stops routing to the task
+func (app *App) readinessHandler(w http.ResponseWriter, r *http.Request) {
+	if app.health.ShuttingDown() {
+		app.writeHealthResponse(w, HealthResponse{Status: HealthFail, Timestamp: time.Now()})
+		return
+	}
 
-	var dbStatus string
-	if err := app.db.Ping(ctx); err != nil {
-		dbStatus = "unhealthy"
-		app.logger.Error("Database health check failed", "error", err)
-	} else {
-		dbStatus = "healthy"
+	response := app.health.Check(r.Context())
+	if !app.health.Started() {
+		response.Status = HealthFail
 	}
+	if response.Status == HealthFail {
+		app.logger.WarnContext(r.Context(), "Readiness check failed", "checks", response.Checks)
+	}
+	app.writeHealthResponse(w, response)
+}
 
-	response := HealthResponse{
-		Status:    "healthy",
-		Timestamp: time.Now(),
-		Database:  dbStatus,
+// startupHandler passes once startup, including the schema setup, has finished
+func (app *App) startupHandler(w http.ResponseWriter, r *http.Request) {
+	status := HealthPass
+	if !app.health.Started() {
+		status = HealthFail
 	}
+	app.writeHealthResponse(w, HealthResponse{Status: status, Timestamp: time.Now()})
+}
 
+func (app *App) writeHealthResponse(w http.ResponseWriter, response HealthResponse) {
 	w.Header().Set("Content-Type", "application/json")
+	if response.Status == HealthFail {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
 	json.NewEncoder(w).Encode(response)
 }
 
+// poolStatsHandler returns the current connection pool statistics
+func (app *App) poolStatsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(app.db.Stats())
+}
+
+// getLogLevelHandler returns the current global log level
+func (app *App) getLogLevelHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(LogLevelRequest{Level: app.logLevel.Level().String()})
+}
+
+// setLogLevelHandler changes the global log level, e.g. {"level": "DEBUG"}
+func (app *App) setLogLevelHandler(w http.ResponseWriter, r *http.Request) {
+	var request LogLevelRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		app.returnErrorResponse(w, r, "Invalid JSON", ValidationError(err))
+		return
+	}
+
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(request.Level)); err != nil {
+		app.returnErrorResponse(w, r, "Invalid log level", ValidationError(err))
+		return
+	}
+
+	app.logLevel.Set(level)
+	app.logger.InfoContext(r.Context(), "Log level changed", "level", level.String())
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(LogLevelRequest{Level: level.String()})
+}
+
+// listCoffeeOrdersHandler lists coffee orders page by page, see parseListCoffeeOrdersQuery for the parameters
+func (app *App) listCoffeeOrdersHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	query, err := parseListCoffeeOrdersQuery(r.URL.Query())
+	if err != nil {
+		app.returnErrorResponse(w, r, "Invalid coffee order query", err)
+		return
+	}
+
+	page, err := app.orders.ListCoffeeOrders(ctx, query)
+	if err != nil {
+		app.returnErrorResponse(w, r, "Failed to list coffee orders", err)
+		return
+	}
+
+	trace.SpanFromContext(ctx).SetAttributes(
+		attribute.Int("coffee.orders.count", len(page.Orders)),
+		attribute.Bool("coffee.orders.has_next_page", page.NextCursor != ""),
+	)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
+
 func (app *App) getCoffeeOrderHandler(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 
-	idStr := chi.URLParam(r, "id")
-	id, err := strconv.Atoi(idStr)
+	id, err := parseOrderID(chi.URLParam(r, "id"))
 	if err != nil {
-		app.returnErrorResponse(w, r, "Invalid coffee order ID", err)
+		app.returnErrorResponse(w, r, "Invalid coffee order ID", ValidationError(err))
 		return
 	}
 
-	order, err := app.db.GetCoffeeOrder(ctx, id)
+	order, err := app.orders.GetCoffeeOrder(ctx, id)
 	if err != nil {
 		app.returnErrorResponse(w, r, "Failed to get coffee order", err)
 		return
 	}
 
+	w.Header().Set("ETag", orderETag(order.Version))
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(order)
 }
 
-func (app *App) createCoffeeOrderTomHandler(w http.ResponseWriter, r *http.Request) {
+// parseOrderID parses the ID of an order. IDs are SERIAL, so values outside
+// int32 are rejected here rather than failing to encode in the query.
+func parseOrderID(s string) (int, error) {
+	id, err := strconv.ParseInt(s, 10, 32)
+	if err != nil {
+		return 0, err
+	}
+	return int(id), nil
+}
+
+// updateCoffeeOrderHandler moves an order to the state in the body, e.g. {"status": "brewing"}
+func (app *App) updateCoffeeOrderHandler(w http.ResponseWriter, r *http.Request) {
+	var update UpdateCoffeeOrder
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		app.returnErrorResponse(w, r, "Invalid JSON", ValidationError(err))
+		return
+	}
+	if !update.Status.Valid() {
+		app.returnErrorResponse(w, r, "Invalid coffee order update", ValidationError(ValidationErrors{{
+			Field:   "status",
+			Code:    "invalid",
+			Message: "must be one of placed, brewing, ready, picked_up, cancelled",
+		}}))
+		return
+	}
+
+	app.transitionCoffeeOrder(w, r, update.Status)
+}
+
+// cancelCoffeeOrderHandler cancels an order that has not been picked up
+func (app *App) cancelCoffeeOrderHandler(w http.ResponseWriter, r *http.Request) {
+	app.transitionCoffeeOrder(w, r, StatusCancelled)
+}
+
+// transitionCoffeeOrder moves the order in the URL to the state to. Requests
+// without If-Match get 428. Illegal transitions get 409, and an If-Match header
+// that does not match the current version gets 412; both are counted as update
+// conflicts. Every transition is
+// recorded as a span event and counted by its from and to states.
+func (app *App) transitionCoffeeOrder(w http.ResponseWriter, r *http.Request, to OrderStatus) {
 	ctx := r.Context()
 
-	var coffeeOrder CreateCoffeeOrder
-	if err := json.NewDecoder(r.Body).Decode(&coffeeOrder); err != nil {
-		app.returnErrorResponse(w, r, "Invalid JSON", err)
+	id, err := parseOrderID(chi.URLParam(r, "id"))
+	if err != nil {
+		app.returnErrorResponse(w, r, "Invalid coffee order ID", ValidationError(err))
+		return
+	}
+
+	ifMatch, err := parseIfMatch(r.Header.Get("If-Match"))
+	if err != nil {
+		app.returnErrorResponse(w, r, "Invalid If-Match header", err)
 		return
 	}
 
-	query := "INSERT INTO coffee_orders (user_name, coffee_type) VALUES ($1, $2) RETURNING id, user_name, coffee_type, created_at"
+	order, from, err := app.orders.UpdateCoffeeOrderStatus(ctx, id, to, ifMatch)
+	if err != nil {
+		if kind := errorKind(err); kind == KindConflict || kind == KindPreconditionFailed {
+			trace.SpanFromContext(ctx).AddEvent("order.update_conflict", trace.WithAttributes(
+				attribute.Int("order.id", id),
+				attribute.String("order.conflict", string(kind)),
+				attribute.IntSlice("order.if_versions", ifMatch.Versions),
+			))
+			app.metrics.sendOrderUpdateConflictMetrics(ctx, kind)
+		}
+		app.returnErrorResponse(w, r, "Failed to update coffee order", err)
+		return
+	}
+
+	trace.SpanFromContext(ctx).AddEvent("order.status_transition", trace.WithAttributes(
+		attribute.Int("order.id", order.ID),
+		attribute.String("order.status.from", string(from)),
+		attribute.String("order.status.to", string(to)),
+	))
+	app.logger.InfoContext(ctx, "Coffee order status changed", "order_id", order.ID, "from", from, "to", to)
+	app.metrics.sendOrderStatusTransitionMetrics(ctx, from, to)
+
+	w.Header().Set("ETag", orderETag(order.Version))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(order)
+}
+
+func (app *App) createCoffeeOrderTomHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	coffeeOrder, err := app.decodeCoffeeOrder(r)
+	if err != nil {
+		app.returnErrorResponse(w, r, "Invalid coffee order", err)
+		return
+	}
 
 	// Add sleep
 	time.Sleep(3 * time.Second)
 
-	var createdOrder CoffeeOrder
-	err := app.db.pool.QueryRow(ctx, query, coffeeOrder.UserName, coffeeOrder.CoffeeType).Scan(
-		&createdOrder.ID, &createdOrder.UserName, &createdOrder.CoffeeType, &createdOrder.CreatedAt)
+	createdOrder, err := app.orders.CreateCoffeeOrder(ctx, coffeeOrder)
 	if err != nil {
 		app.returnErrorResponse(w, r, "Failed to create coffee order", err)
 		return
 	}
 
-	go app.metrics.sendCreatedCoffeeOrderMetrics(ctx, createdOrder.CoffeeType, createdOrder.UserName)
+	app.metrics.sendCreatedCoffeeOrderMetricsAsync(ctx, createdOrder.CoffeeType, createdOrder.UserName)
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
@@ -104,9 +290,8 @@ func (app *App) createCoffeeOrderTomHandler(w http.ResponseWriter, r *http.Reque
 }
 
 func (app *App) createCoffeeOrderHonzaHandler(w http.ResponseWriter, r *http.Request) {
-	var coffeeOrder CreateCoffeeOrder
-	if err := json.NewDecoder(r.Body).Decode(&coffeeOrder); err != nil {
-		app.returnErrorResponse(w, r, "Invalid JSON", err)
+	if _, err := app.decodeCoffeeOrder(r); err != nil {
+		app.returnErrorResponse(w, r, "Invalid coffee order", err)
 		return
 	}
 
@@ -116,9 +301,9 @@ func (app *App) createCoffeeOrderHonzaHandler(w http.ResponseWriter, r *http.Req
 func (app *App) createCoffeeOrderMarekHandler(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 
-	var coffeeOrder CreateCoffeeOrder
-	if err := json.NewDecoder(r.Body).Decode(&coffeeOrder); err != nil {
-		app.returnErrorResponse(w, r, "Invalid JSON", err)
+	coffeeOrder, err := app.decodeCoffeeOrder(r)
+	if err != nil {
+		app.returnErrorResponse(w, r, "Invalid coffee order", err)
 		return
 	}
 
@@ -131,13 +316,13 @@ func (app *App) createCoffeeOrderMarekHandler(w http.ResponseWriter, r *http.Req
 	time.Sleep(1 * time.Second)
 
 	// Create the coffee order after memory allocation
-	order, err := app.db.CreateCoffeeOrder(ctx, coffeeOrder)
+	order, err := app.orders.CreateCoffeeOrder(ctx, coffeeOrder)
 	if err != nil {
 		app.returnErrorResponse(w, r, "Failed to create coffee order", err)
 		return
 	}
 
-	go app.metrics.sendCreatedCoffeeOrderMetrics(ctx, order.CoffeeType, order.UserName)
+	app.metrics.sendCreatedCoffeeOrderMetricsAsync(ctx, order.CoffeeType, order.UserName)
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
@@ -147,25 +332,25 @@ func (app *App) createCoffeeOrderMarekHandler(w http.ResponseWriter, r *http.Req
 func (app *App) createCoffeeOrderJakubHandler(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 
-	var coffeeOrder CreateCoffeeOrder
-	if err := json.NewDecoder(r.Body).Decode(&coffeeOrder); err != nil {
-		app.returnErrorResponse(w, r, "Invalid JSON", err)
+	coffeeOrder, err := app.decodeCoffeeOrder(r)
+	if err != nil {
+		app.returnErrorResponse(w, r, "Invalid coffee order", err)
 		return
 	}
 
 	// Viking's unnecessary select queries
 	for i := 0; i < 10; i++ {
-		app.db.GetCoffeeOrder(ctx, i)
+		app.orders.GetCoffeeOrder(ctx, i)
 	}
 
 	// Create the actual coffee order
-	order, err := app.db.CreateCoffeeOrder(ctx, coffeeOrder)
+	order, err := app.orders.CreateCoffeeOrder(ctx, coffeeOrder)
 	if err != nil {
 		app.returnErrorResponse(w, r, "Failed to create coffee order", err)
 		return
 	}
 
-	go app.metrics.sendCreatedCoffeeOrderMetrics(ctx, order.CoffeeType, order.UserName)
+	app.metrics.sendCreatedCoffeeOrderMetricsAsync(ctx, order.CoffeeType, order.UserName)
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
@@ -175,9 +360,9 @@ func (app *App) createCoffeeOrderJakubHandler(w http.ResponseWriter, r *http.Req
 func (app *App) createCoffeeOrderMatusHandler(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 
-	var coffeeOrder CreateCoffeeOrder
-	if err := json.NewDecoder(r.Body).Decode(&coffeeOrder); err != nil {
-		app.returnErrorResponse(w, r, "Invalid JSON", err)
+	coffeeOrder, err := app.decodeCoffeeOrder(r)
+	if err != nil {
+		app.returnErrorResponse(w, r, "Invalid coffee order", err)
 		return
 	}
 
@@ -187,13 +372,13 @@ func (app *App) createCoffeeOrderMatusHandler(w http.ResponseWriter, r *http.Req
 		CoffeeType: "borovicka", // Always borovicka!
 	}
 
-	order, err := app.db.CreateCoffeeOrder(ctx, modifiedOrder)
+	order, err := app.orders.CreateCoffeeOrder(ctx, modifiedOrder)
 	if err != nil {
 		app.returnErrorResponse(w, r, "Failed to create coffee order", err)
 		return
 	}
 
-	go app.metrics.sendCreatedCoffeeOrderMetrics(ctx, order.CoffeeType, order.UserName)
+	app.metrics.sendCreatedCoffeeOrderMetricsAsync(ctx, order.CoffeeType, order.UserName)
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
@@ -203,43 +388,115 @@ func (app *App) createCoffeeOrderMatusHandler(w http.ResponseWriter, r *http.Req
 func (app *App) createCoffeeOrderMilaHandler(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 
-	var coffeeOrder CreateCoffeeOrder
-	if err := json.NewDecoder(r.Body).Decode(&coffeeOrder); err != nil {
-		app.returnErrorResponse(w, r, "Invalid JSON", err)
+	coffeeOrder, err := app.decodeCoffeeOrder(r)
+	if err != nil {
+		app.returnErrorResponse(w, r, "Invalid coffee order", err)
 		return
 	}
 
-	order, err := app.db.CreateCoffeeOrderInOneHour(ctx, coffeeOrder)
+	order, err := app.orders.CreateCoffeeOrderInOneHour(ctx, coffeeOrder)
 	if err != nil {
 		app.returnErrorResponse(w, r, "Failed to create coffee order", err)
 		return
 	}
 
-	go app.metrics.sendCreatedCoffeeOrderMetrics(ctx, order.CoffeeType, order.UserName)
+	app.metrics.sendCreatedCoffeeOrderMetricsAsync(ctx, order.CoffeeType, order.UserName)
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(order)
 }
 
-// returnErrorResponse logs errors and sends error responses
+// decodeCoffeeOrder decodes and validates the order in the request body. The
+// coffee type must be in the catalog; unknown types are counted as a business metric.
+func (app *App) decodeCoffeeOrder(r *http.Request) (CreateCoffeeOrder, error) {
+	ctx := r.Context()
+
+	var coffeeOrder CreateCoffeeOrder
+	if err := json.NewDecoder(r.Body).Decode(&coffeeOrder); err != nil {
+		return coffeeOrder, ValidationError(err)
+	}
+
+	coffeeOrder.UserName = strings.TrimSpace(coffeeOrder.UserName)
+	coffeeOrder.CoffeeType = strings.ToLower(strings.TrimSpace(coffeeOrder.CoffeeType))
+	if err := validate(coffeeOrder); err != nil {
+		return coffeeOrder, ValidationError(err)
+	}
+
+	exists, err := app.orders.CoffeeTypeExists(ctx, coffeeOrder.CoffeeType)
+	if err != nil {
+		return coffeeOrder, fmt.Errorf("failed to look up coffee type: %w", err)
+	}
+	if !exists {
+		app.metrics.sendUnknownCoffeeTypeMetrics(ctx, coffeeOrder.CoffeeType)
+		return coffeeOrder, ValidationError(ValidationErrors{{
+			Field:   "coffee_type",
+			Code:    "unknown_coffee_type",
+			Message: fmt.Sprintf("%q is not on the menu", coffeeOrder.CoffeeType),
+		}})
+	}
+
+	return coffeeOrder, nil
+}
+
+// returnErrorResponse logs err and responds with a problem whose status code
+// follows the kind of err. Client errors include the error text in the detail;
+// server errors only show message, so internals do not leak.
 func (app *App) returnErrorResponse(w http.ResponseWriter, r *http.Request, message string, err error) {
-	requestID := getRequestID(r.Context())
-	traceID := trace.SpanFromContext(r.Context()).SpanContext().TraceID().String()
+	if isBodyTooLarge(err) {
+		app.rejectBodyTooLarge(w, r)
+		return
+	}
+
+	ctx := r.Context()
+	kind := errorKind(err)
+	statusCode := kind.StatusCode()
 
-	app.logger.Error(message,
-		"request_id", requestID,
-		"trace_id", traceID,
+	detail := message
+	if statusCode < 500 {
+		detail = message + ": " + err.Error()
+	}
+
+	log := app.logger.WarnContext
+	if statusCode >= 500 {
+		log = app.logger.ErrorContext
+		trace.SpanFromContext(ctx).RecordError(err)
+	}
+	log(ctx, message,
 		"error", err,
+		"error_type", kind,
 		"method", r.Method,
 		"path", r.URL.Path,
 	)
 
-	errorResponse := ErrorResponse{
-		Error: message,
+	var fieldErrs ValidationErrors
+	errors.As(err, &fieldErrs)
+
+	writeProblem(w, r, kind, detail, fieldErrs...)
+}
+
+// writeProblem writes an application/problem+json response with the status
+// code of kind. The kind is also recorded in the request context, where the
+// tracing and metrics middleware pick it up for the span and the error metrics.
+func writeProblem(w http.ResponseWriter, r *http.Request, kind ErrorKind, detail string, fieldErrs ...FieldError) {
+	setErrorType(r.Context(), kind)
+
+	statusCode := kind.StatusCode()
+	problem := ProblemDetails{
+		Type:      "about:blank",
+		Title:     http.StatusText(statusCode),
+		Status:    statusCode,
+		Detail:    detail,
+		Instance:  r.URL.Path,
+		ErrorType: string(kind),
+		RequestID: getRequestID(r.Context()),
+		Errors:    fieldErrs,
+	}
+	if spanContext := trace.SpanContextFromContext(r.Context()); spanContext.IsValid() {
+		problem.TraceID = spanContext.TraceID().String()
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusInternalServerError)
-	json.NewEncoder(w).Encode(errorResponse)
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(problem)
 }
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestOrderIDsOutsideInt32AreInvalid(t *testing.T) {
+	cursor := base64.RawURLEncoding.EncodeToString([]byte("2024-01-02T15:04:05Z|9999999999|desc|" + ListCoffeeOrdersQuery{}.filterHash()))
+
+	tests := []struct {
+		name   string
+		method string
+		target string
+	}{
+		{name: "get", method: http.MethodGet, target: "/coffee/9999999999"},
+		{name: "cancel", method: http.MethodPost, target: "/coffee/9999999999/cancel"},
+		{name: "list cursor", method: http.MethodGet, target: "/coffee?cursor=" + cursor},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t)
+
+			w := app.serve(httptest.NewRequest(tt.method, tt.target, strings.NewReader("")))
+			if w.Code != http.StatusBadRequest {
+				t.Fatalf("status = %d, want 400: %s", w.Code, w.Body)
+			}
+			var problem ProblemDetails
+			if err := json.NewDecoder(w.Body).Decode(&problem); err != nil {
+				t.Fatal(err)
+			}
+			if problem.ErrorType != string(KindValidation) {
+				t.Errorf("error_type = %q, want validation", problem.ErrorType)
+			}
+		})
+	}
+}
+
+// seedOrders creates n orders, alternating between two users
+func seedOrders(t *testing.T, app *testApp, n int) {
+	t.Helper()
+
+	for i := 0; i < n; i++ {
+		userName := []string{"tom", "mila"}[i%2]
+		if _, err := app.repository.CreateCoffeeOrder(context.Background(), CreateCoffeeOrder{UserName: userName, CoffeeType: "latte"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// patchStatus sends PATCH /coffee/{id} with the status and If-Match header
+func patchStatus(app *testApp, id int, status OrderStatus, ifMatch string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPatch, "/coffee/"+strconv.Itoa(id), strings.NewReader(`{"status": "`+string(status)+`"}`))
+	if ifMatch != "" {
+		r.Header.Set("If-Match", ifMatch)
+	}
+	return app.serve(r)
+}
+
+func TestGetCoffeeOrder(t *testing.T) {
+	app := newTestApp(t)
+	seedOrders(t, app, 1)
+
+	w := app.serve(httptest.NewRequest(http.MethodGet, "/coffee/1", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", w.Code, w.Body)
+	}
+	if etag := w.Header().Get("ETag"); etag != `"1"` {
+		t.Errorf("ETag = %s, want \"1\"", etag)
+	}
+	var order CoffeeOrder
+	if err := json.NewDecoder(w.Body).Decode(&order); err != nil {
+		t.Fatal(err)
+	}
+	if order.ID != 1 || order.UserName != "tom" || order.Status != StatusPlaced {
+		t.Errorf("order = %+v, want order 1 of tom, placed", order)
+	}
+
+	if w := app.serve(httptest.NewRequest(http.MethodGet, "/coffee/2", nil)); w.Code != http.StatusNotFound {
+		t.Errorf("missing order status = %d, want 404", w.Code)
+	}
+}
+
+func TestListCoffeeOrdersPagination(t *testing.T) {
+	tests := []struct {
+		name    string
+		query   string
+		wantIDs []int
+	}{
+		{name: "newest first", query: "limit=2", wantIDs: []int{5, 4, 3, 2, 1}},
+		{name: "oldest first", query: "limit=2&sort=created_at", wantIDs: []int{1, 2, 3, 4, 5}},
+		{name: "filtered by user", query: "limit=2&user_name=tom", wantIDs: []int{5, 3, 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t)
+			seedOrders(t, app, 5)
+
+			var ids []int
+			var pages int
+			target := "/coffee?" + tt.query
+			for {
+				w := app.serve(httptest.NewRequest(http.MethodGet, target, nil))
+				if w.Code != http.StatusOK {
+					t.Fatalf("status = %d, want 200: %s", w.Code, w.Body)
+				}
+				var page CoffeeOrderPage
+				if err := json.NewDecoder(w.Body).Decode(&page); err != nil {
+					t.Fatal(err)
+				}
+				pages++
+				for _, order := range page.Orders {
+					ids = append(ids, order.ID)
+				}
+				if page.NextCursor == "" {
+					break
+				}
+				if pages > len(tt.wantIDs) {
+					t.Fatalf("pagination does not end, got %v so far", ids)
+				}
+				target = "/coffee?" + tt.query + "&cursor=" + page.NextCursor
+			}
+
+			if !slices.Equal(ids, tt.wantIDs) {
+				t.Errorf("listed %v, want %v", ids, tt.wantIDs)
+			}
+			if wantPages := (len(tt.wantIDs) + 1) / 2; pages != wantPages {
+				t.Errorf("listed %d pages, want %d", pages, wantPages)
+			}
+		})
+	}
+}
+
+func TestCoffeeOrderTransitions(t *testing.T) {
+	app := newTestApp(t)
+	seedOrders(t, app, 1)
+
+	w := patchStatus(app, 1, StatusBrewing, `"1"`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("placed -> brewing status = %d, want 200: %s", w.Code, w.Body)
+	}
+	if etag := w.Header().Get("ETag"); etag != `"2"` {
+		t.Errorf("ETag after the update = %s, want \"2\"", etag)
+	}
+
+	// Orders move forward one step at a time
+	if w := patchStatus(app, 1, StatusPickedUp, `"2"`); w.Code != http.StatusConflict {
+		t.Errorf("brewing -> picked_up status = %d, want 409: %s", w.Code, w.Body)
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/coffee/1/cancel", nil)
+	r.Header.Set("If-Match", `"2"`)
+	if w := app.serve(r); w.Code != http.StatusOK {
+		t.Fatalf("cancel status = %d, want 200: %s", w.Code, w.Body)
+	}
+
+	// Cancelled orders are final
+	if w := patchStatus(app, 1, StatusBrewing, `"3"`); w.Code != http.StatusConflict {
+		t.Errorf("cancelled -> brewing status = %d, want 409: %s", w.Code, w.Body)
+	}
+
+	conflicts := app.recorder.Sum("OrderUpdateConflicts_ByType", Dimension{Name: "ErrorType", Value: string(KindConflict)})
+	if conflicts != 2 || app.recorder.Sum("OrderUpdateConflicts_Total") != 2 {
+		t.Errorf("OrderUpdateConflicts_ByType{conflict} = %g, want the 2 illegal transitions", conflicts)
+	}
+	transitions := app.recorder.Sum("OrderStatusTransitions", Dimension{Name: "From", Value: "placed"}, Dimension{Name: "To", Value: "brewing"})
+	if transitions != 1 {
+		t.Errorf("OrderStatusTransitions{placed, brewing} = %g, want 1", transitions)
+	}
+}
+
+func TestCoffeeOrderIfMatch(t *testing.T) {
+	tests := []struct {
+		name       string
+		ifMatch    string
+		wantStatus int
+	}{
+		{name: "missing", ifMatch: "", wantStatus: http.StatusPreconditionRequired},
+		{name: "current version", ifMatch: `"1"`, wantStatus: http.StatusOK},
+		{name: "any version", ifMatch: "*", wantStatus: http.StatusOK},
+		{name: "list with the current version", ifMatch: `"3", "1"`, wantStatus: http.StatusOK},
+		{name: "stale version", ifMatch: `"2"`, wantStatus: http.StatusPreconditionFailed},
+		{name: "list without the current version", ifMatch: `"2", W/"1", "9999999999"`, wantStatus: http.StatusPreconditionFailed},
+		{name: "weak ETag", ifMatch: `W/"1"`, wantStatus: http.StatusPreconditionFailed},
+		{name: "unquoted ETag", ifMatch: "1", wantStatus: http.StatusBadRequest},
+		{name: "unquoted ETag in a list", ifMatch: `"1", 2`, wantStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t)
+			seedOrders(t, app, 1)
+
+			w := patchStatus(app, 1, StatusBrewing, tt.ifMatch)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+
+			order, err := app.repository.GetCoffeeOrder(context.Background(), 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if updated := order.Status == StatusBrewing; updated != (tt.wantStatus == http.StatusOK) {
+				t.Errorf("order status = %s after a %d response", order.Status, w.Code)
+			}
+		})
+	}
+}
+
+func TestListCursorOnlyContinuesItsListing(t *testing.T) {
+	app := newTestApp(t)
+	seedOrders(t, app, 3)
+
+	w := app.serve(httptest.NewRequest(http.MethodGet, "/coffee?limit=1&sort=-created_at&user_name=tom", nil))
+	var page CoffeeOrderPage
+	if err := json.NewDecoder(w.Body).Decode(&page); err != nil {
+		t.Fatal(err)
+	}
+	if page.NextCursor == "" {
+		t.Fatal("first page has no next_cursor")
+	}
+
+	tests := []struct {
+		name       string
+		query      string
+		wantStatus int
+	}{
+		{name: "same listing", query: "limit=1&sort=-created_at&user_name=tom", wantStatus: http.StatusOK},
+		{name: "different sort", query: "limit=1&sort=created_at&user_name=tom", wantStatus: http.StatusBadRequest},
+		{name: "different filter", query: "limit=1&sort=-created_at&user_name=mila", wantStatus: http.StatusBadRequest},
+		{name: "filter dropped", query: "limit=1&sort=-created_at", wantStatus: http.StatusBadRequest},
+		{name: "different page size", query: "limit=5&sort=-created_at&user_name=tom", wantStatus: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := app.serve(httptest.NewRequest(http.MethodGet, "/coffee?"+tt.query+"&cursor="+page.NextCursor, nil))
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+		})
+	}
+}
+
+func TestCreateCoffeeOrderValidation(t *testing.T) {
+	tests := []struct {
+		name      string
+		body      string
+		wantField string
+		wantCode  string
+	}{
+		{name: "empty user name", body: `{"user_name": "  ", "coffee_type": "latte"}`, wantField: "user_name", wantCode: "required"},
+		{name: "user name too long", body: `{"user_name": "` + strings.Repeat("á", 101) + `", "coffee_type": "latte"}`, wantField: "user_name", wantCode: "too_long"},
+		{name: "user name characters", body: `{"user_name": "tom<script>", "coffee_type": "latte"}`, wantField: "user_name", wantCode: "invalid_characters"},
+		{name: "unknown coffee type", body: `{"user_name": "tom", "coffee_type": "Pumpkin_Spice"}`, wantField: "coffee_type", wantCode: "unknown_coffee_type"},
+	}
+	for _, path := range []string{"/make-coffee-matus", "/make-coffee-mila"} {
+		for _, tt := range tests {
+			t.Run(path+" "+tt.name, func(t *testing.T) {
+				app := newTestApp(t)
+
+				w := app.serve(httptest.NewRequest(http.MethodPost, path, strings.NewReader(tt.body)))
+				if w.Code != http.StatusBadRequest {
+					t.Fatalf("status = %d, want 400: %s", w.Code, w.Body)
+				}
+				var problem ProblemDetails
+				if err := json.NewDecoder(w.Body).Decode(&problem); err != nil {
+					t.Fatal(err)
+				}
+				if problem.ErrorType != string(KindValidation) {
+					t.Errorf("error_type = %q, want validation", problem.ErrorType)
+				}
+				if len(problem.Errors) != 1 || problem.Errors[0].Field != tt.wantField || problem.Errors[0].Code != tt.wantCode || problem.Errors[0].Message == "" {
+					t.Errorf("errors = %+v, want one %s error for %s", problem.Errors, tt.wantCode, tt.wantField)
+				}
+
+				if w := app.serve(httptest.NewRequest(http.MethodGet, "/coffee/1", nil)); w.Code != http.StatusNotFound {
+					t.Errorf("GET /coffee/1 status = %d, want 404 as no order is created", w.Code)
+				}
+				wantUnknown := 0.0
+				if tt.wantCode == "unknown_coffee_type" {
+					wantUnknown = 1
+				}
+				if got := app.recorder.Sum("UnknownCoffeeTypeOrders_ByType", Dimension{Name: "UnknownCoffeeType", Value: "pumpkin_spice"}); got != wantUnknown {
+					t.Errorf("UnknownCoffeeTypeOrders_ByType{pumpkin_spice} = %g, want %g", got, wantUnknown)
+				}
+			})
+		}
+	}
+}
+
+func TestCreateCoffeeOrderAcceptsLongestName(t *testing.T) {
+	app := newTestApp(t)
+	userName := strings.Repeat("á", 100)
+
+	w := app.serve(httptest.NewRequest(http.MethodPost, "/make-coffee-mila", strings.NewReader(`{"user_name": " `+userName+` ", "coffee_type": "Latte"}`)))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("status = %d, want 201: %s", w.Code, w.Body)
+	}
+	var order CoffeeOrder
+	if err := json.NewDecoder(w.Body).Decode(&order); err != nil {
+		t.Fatal(err)
+	}
+	if order.UserName != userName || order.CoffeeType != "latte" {
+		t.Errorf("order user_name = %q, coffee_type = %q; want the trimmed name and latte", order.UserName, order.CoffeeType)
+	}
+}
@@ -1,6 +1,14 @@
 package main
 
-import "os"
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
 
 // Config holds all configuration for the application
 type Config struct {
@@ -11,6 +19,47 @@ type Config struct {
 	DBPassword string
 	Region     string
 	Port       string
+
+	HTTPReadHeaderTimeout time.Duration
+	HTTPReadTimeout       time.Duration
+	HTTPWriteTimeout      time.Duration
+	HTTPIdleTimeout       time.Duration
+	HTTPMaxBodyBytes      int
+	HTTPMaxInFlight       int
+	HTTPShedRetryAfter    time.Duration
+
+	MigrateOnStart bool
+
+	ShutdownDrainPeriod time.Duration
+	ShutdownTimeout     time.Duration
+
+	PIIRedaction     RedactionPolicy
+	PIIRedactionSalt string
+	PIIKeys          []string
+
+	AdminToken string
+
+	LogLevel      slog.Level
+	LogSpanEvents bool
+
+	OTLPEndpoint            string
+	XRayTracing             bool
+	TraceSampler            string
+	TraceSamplerArg         float64
+	TraceRateLimit          float64
+	TraceAlwaysSampleRoutes []string
+	TraceNeverSampleRoutes  []string
+
+	DBPoolStatsInterval  time.Duration
+	RuntimeStatsInterval time.Duration
+
+	MetricsBackend       string
+	MetricsFlushInterval time.Duration
+	MetricsQueueSize     int
+
+	MetricsDimensionLimits     map[string]int
+	MetricsDimensionAllowlists map[string][]string
+	MetricsDimensionWindow     time.Duration
 }
 
 // LoadConfig loads configuration from environment variables
@@ -23,7 +72,93 @@ func LoadConfig() *Config {
 		DBPassword: getEnv("DB_PASSWORD", "password"),
 		Region:     getEnv("AWS_REGION", "eu-central-1"),
 		Port:       getEnv("PORT", "8080"),
+
+		HTTPReadHeaderTimeout: getEnvDuration("HTTP_READ_HEADER_TIMEOUT", 5*time.Second),
+		HTTPReadTimeout:       getEnvDuration("HTTP_READ_TIMEOUT", 15*time.Second),
+		HTTPWriteTimeout:      getEnvDuration("HTTP_WRITE_TIMEOUT", 30*time.Second),
+		HTTPIdleTimeout:       getEnvDuration("HTTP_IDLE_TIMEOUT", 120*time.Second),
+		HTTPMaxBodyBytes:      getEnvInt("HTTP_MAX_BODY_BYTES", 1<<20),
+		HTTPMaxInFlight:       getEnvInt("HTTP_MAX_IN_FLIGHT", 100),
+		HTTPShedRetryAfter:    getEnvDuration("HTTP_SHED_RETRY_AFTER", time.Second),
+
+		MigrateOnStart: getEnv("MIGRATE_ON_START", "true") == "true",
+
+		ShutdownDrainPeriod: getEnvDuration("SHUTDOWN_DRAIN_PERIOD", 5*time.Second),
+		ShutdownTimeout:     getEnvDuration("SHUTDOWN_TIMEOUT", 20*time.Second),
+
+		PIIRedaction:     RedactionPolicy(getEnv("PII_REDACTION", "hash")),
+		PIIRedactionSalt: getEnv("PII_REDACTION_SALT", ""),
+		PIIKeys:          getEnvList("PII_KEYS", "user_name"),
+
+		AdminToken: getEnv("ADMIN_TOKEN", ""),
+
+		LogLevel:      getEnvLevel("LOG_LEVEL", slog.LevelInfo),
+		LogSpanEvents: getEnv("LOG_SPAN_EVENTS", "false") == "true",
+
+		OTLPEndpoint:            getEnv("OTEL_EXPORTER_OTLP_ENDPOINT", "http://localhost:4318"),
+		XRayTracing:             getEnv("TRACE_XRAY", "false") == "true",
+		TraceSampler:            getEnv("OTEL_TRACES_SAMPLER", "parentbased_always_on"),
+		TraceSamplerArg:         getEnvFloat("OTEL_TRACES_SAMPLER_ARG", 1),
+		TraceRateLimit:          getEnvFloat("TRACE_RATE_LIMIT", 0),
+		TraceAlwaysSampleRoutes: getEnvList("TRACE_ALWAYS_SAMPLE_ROUTES", "/make-coffee-honza"),
+		TraceNeverSampleRoutes:  getEnvList("TRACE_NEVER_SAMPLE_ROUTES", "/health,/livez,/readyz,/startupz,/metrics,/debug/*"),
+
+		DBPoolStatsInterval:  getEnvDuration("DB_POOL_STATS_INTERVAL", 15*time.Second),
+		RuntimeStatsInterval: getEnvDuration("RUNTIME_STATS_INTERVAL", 15*time.Second),
+
+		MetricsBackend:       getEnv("METRICS_BACKEND", "cloudwatch"),
+		MetricsFlushInterval: getEnvDuration("METRICS_FLUSH_INTERVAL", 10*time.Second),
+		MetricsQueueSize:     getEnvInt("METRICS_QUEUE_SIZE", 10000),
+
+		MetricsDimensionLimits:     parseDimensionLimits(getEnv("METRICS_DIMENSION_LIMITS", "UserName=50,CoffeeType=20,UnknownCoffeeType=20")),
+		MetricsDimensionAllowlists: parseDimensionAllowlists(getEnv("METRICS_DIMENSION_ALLOWLISTS", "")),
+		MetricsDimensionWindow:     getEnvDuration("METRICS_DIMENSION_WINDOW", time.Hour),
+	}
+}
+
+// Validate checks the values that would otherwise fail at runtime, such as a
+// zero interval that panics the ticker of a collector. Every invalid variable
+// is reported by name.
+func (c *Config) Validate() error {
+	var errs []error
+	positiveDuration := func(key string, value time.Duration) {
+		if value <= 0 {
+			errs = append(errs, fmt.Errorf("%s must be a positive duration, got %s", key, value))
+		}
+	}
+	positiveInt := func(key string, value int) {
+		if value <= 0 {
+			errs = append(errs, fmt.Errorf("%s must be positive, got %d", key, value))
+		}
+	}
+
+	positiveDuration("HTTP_READ_HEADER_TIMEOUT", c.HTTPReadHeaderTimeout)
+	positiveDuration("HTTP_READ_TIMEOUT", c.HTTPReadTimeout)
+	positiveDuration("HTTP_WRITE_TIMEOUT", c.HTTPWriteTimeout)
+	positiveDuration("HTTP_IDLE_TIMEOUT", c.HTTPIdleTimeout)
+	positiveInt("HTTP_MAX_BODY_BYTES", c.HTTPMaxBodyBytes)
+	if c.HTTPMaxInFlight < 0 {
+		errs = append(errs, fmt.Errorf("HTTP_MAX_IN_FLIGHT must not be negative, got %d", c.HTTPMaxInFlight))
 	}
+	positiveDuration("HTTP_SHED_RETRY_AFTER", c.HTTPShedRetryAfter)
+	if c.ShutdownDrainPeriod < 0 {
+		errs = append(errs, fmt.Errorf("SHUTDOWN_DRAIN_PERIOD must not be negative, got %s", c.ShutdownDrainPeriod))
+	}
+	positiveDuration("SHUTDOWN_TIMEOUT", c.ShutdownTimeout)
+	positiveDuration("DB_POOL_STATS_INTERVAL", c.DBPoolStatsInterval)
+	positiveDuration("RUNTIME_STATS_INTERVAL", c.RuntimeStatsInterval)
+	positiveDuration("METRICS_FLUSH_INTERVAL", c.MetricsFlushInterval)
+	positiveInt("METRICS_QUEUE_SIZE", c.MetricsQueueSize)
+	positiveDuration("METRICS_DIMENSION_WINDOW", c.MetricsDimensionWindow)
+	if c.TraceRateLimit < 0 {
+		errs = append(errs, fmt.Errorf("TRACE_RATE_LIMIT must not be negative, got %g", c.TraceRateLimit))
+	}
+	// An unsalted HMAC of a short user name can be reversed by brute force
+	if c.PIIRedaction == RedactHash && c.PIIRedactionSalt == "" {
+		errs = append(errs, errors.New("PII_REDACTION_SALT must be set when PII_REDACTION is hash"))
+	}
+
+	return errors.Join(errs...)
 }
 
 // getEnv gets an environment variable or returns a default value
@@ -33,3 +168,47 @@ func getEnv(key, defaultValue string) string {
 	}
 	return defaultValue
 }
+
+// getEnvInt gets an integer environment variable or returns a default value
+func getEnvInt(key string, defaultValue int) int {
+	if value, err := strconv.Atoi(os.Getenv(key)); err == nil {
+		return value
+	}
+	return defaultValue
+}
+
+// getEnvFloat gets a float environment variable or returns a default value
+func getEnvFloat(key string, defaultValue float64) float64 {
+	if value, err := strconv.ParseFloat(os.Getenv(key), 64); err == nil {
+		return value
+	}
+	return defaultValue
+}
+
+// getEnvList gets a comma-separated environment variable or returns the default list
+func getEnvList(key, defaultValue string) []string {
+	var values []string
+	for _, value := range strings.Split(getEnv(key, defaultValue), ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// getEnvLevel gets a log level environment variable (e.g. "debug") or returns a default value
+func getEnvLevel(key string, defaultValue slog.Level) slog.Level {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(os.Getenv(key))); err == nil {
+		return level
+	}
+	return defaultValue
+}
+
+// getEnvDuration gets a duration environment variable (e.g. "10s") or returns a default value
+func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	if value, err := time.ParseDuration(os.Getenv(key)); err == nil {
+		return value
+	}
+	return defaultValue
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDefaultConfigIsValid(t *testing.T) {
+	t.Setenv("PII_REDACTION_SALT", "test-salt")
+
+	if err := LoadConfig().Validate(); err != nil {
+		t.Fatalf("default configuration is invalid: %v", err)
+	}
+}
+
+func TestValidateReportsEveryInvalidVariable(t *testing.T) {
+	t.Setenv("METRICS_FLUSH_INTERVAL", "0s")
+	t.Setenv("RUNTIME_STATS_INTERVAL", "-5s")
+	t.Setenv("METRICS_QUEUE_SIZE", "0")
+	t.Setenv("PII_REDACTION", "hash")
+	t.Setenv("PII_REDACTION_SALT", "")
+
+	err := LoadConfig().Validate()
+	if err == nil {
+		t.Fatal("Validate accepted non-positive intervals, queue size and an empty salt")
+	}
+	for _, key := range []string{"METRICS_FLUSH_INTERVAL", "RUNTIME_STATS_INTERVAL", "METRICS_QUEUE_SIZE", "PII_REDACTION_SALT"} {
+		if !strings.Contains(err.Error(), key) {
+			t.Errorf("error %q does not name %s", err, key)
+		}
+	}
+}
@@ -2,13 +2,15 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
+	"strings"
 	"time"
 
 	"github.com/exaring/otelpgx"
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
-	"go.opentelemetry.io/otel/codes"
 )
 
 // Database wraps pgxpool.Pool with additional functionality
@@ -59,43 +61,23 @@ func (db *Database) Ping(ctx context.Context) error {
 	return db.pool.Ping(ctx)
 }
 
-// initSchema initializes the database schema
-func (app *App) initSchema() error {
-	ctx, span := app.tracer.Start(context.Background(), "initSchema")
-	defer span.End()
-
-	query := `
-	CREATE TABLE IF NOT EXISTS coffee_orders (
-		id SERIAL PRIMARY KEY,
-		user_name VARCHAR(255) NOT NULL,
-		coffee_type VARCHAR(255) NOT NULL,
-		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
-	);
-	`
-
-	_, err := app.db.pool.Exec(ctx, query)
-	if err != nil {
-		span.RecordError(err)
-		span.SetStatus(codes.Error, err.Error())
-		return err
-	}
-
-	span.SetStatus(codes.Ok, "Schema initialized successfully")
-	return nil
-}
-
 // GetCoffeeOrder retrieves a coffee order by ID
 func (db *Database) GetCoffeeOrder(ctx context.Context, id int) (*CoffeeOrder, error) {
-	query := "SELECT id, user_name, coffee_type, created_at FROM coffee_orders WHERE id = $1"
+	query := "SELECT id, user_name, coffee_type, status, version, created_at FROM coffee_orders WHERE id = $1"
 
 	var order CoffeeOrder
 	err := db.pool.QueryRow(ctx, query, id).Scan(
 		&order.ID,
 		&order.UserName,
 		&order.CoffeeType,
+		&order.Status,
+		&order.Version,
 		&order.CreatedAt,
 	)
 
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, NotFoundError(fmt.Errorf("coffee order %d not found", id))
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -103,13 +85,116 @@ func (db *Database) GetCoffeeOrder(ctx context.Context, id int) (*CoffeeOrder, e
 	return &order, nil
 }
 
+// ListCoffeeOrders returns one page of the orders matching query, ordered by
+// (created_at, id). Pages are found by keyset pagination: the next page starts
+// after the (created_at, id) of the cursor, which the indexes on those columns
+// serve without scanning the skipped rows.
+func (db *Database) ListCoffeeOrders(ctx context.Context, query ListCoffeeOrdersQuery) (*CoffeeOrderPage, error) {
+	var conditions []string
+	var args []any
+	where := func(condition string, arg any) {
+		args = append(args, arg)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+
+	if query.UserName != "" {
+		where("user_name = $%d", query.UserName)
+	}
+	if query.CoffeeType != "" {
+		where("coffee_type = $%d", query.CoffeeType)
+	}
+	if query.CreatedAfter != nil {
+		where("created_at >= $%d", *query.CreatedAfter)
+	}
+	if query.CreatedBefore != nil {
+		where("created_at < $%d", *query.CreatedBefore)
+	}
+
+	direction, comparison := "ASC", ">"
+	if query.Descending {
+		direction, comparison = "DESC", "<"
+	}
+	if query.After != nil {
+		args = append(args, query.After.CreatedAt, query.After.ID)
+		conditions = append(conditions, fmt.Sprintf("(created_at, id) %s ($%d, $%d)", comparison, len(args)-1, len(args)))
+	}
+
+	sql := "SELECT id, user_name, coffee_type, status, version, created_at FROM coffee_orders"
+	if len(conditions) > 0 {
+		sql += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	args = append(args, query.Limit+1)
+	sql += fmt.Sprintf(" ORDER BY created_at %s, id %s LIMIT $%d", direction, direction, len(args))
+
+	rows, err := db.pool.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, err
+	}
+	orders, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (CoffeeOrder, error) {
+		var order CoffeeOrder
+		err := row.Scan(&order.ID, &order.UserName, &order.CoffeeType, &order.Status, &order.Version, &order.CreatedAt)
+		return order, err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return newCoffeeOrderPage(orders, query), nil
+}
+
+// UpdateCoffeeOrderStatus moves an order to a new state and returns the
+// updated order and the state it left. The order row is locked while the
+// version and transition are checked, so concurrent updates are applied one
+// after another. The current version must meet ifMatch.
+func (db *Database) UpdateCoffeeOrderStatus(ctx context.Context, id int, to OrderStatus, ifMatch IfMatch) (*CoffeeOrder, OrderStatus, error) {
+	var order CoffeeOrder
+	var from OrderStatus
+	var version int
+
+	err := pgx.BeginFunc(ctx, db.pool, func(tx pgx.Tx) error {
+		err := tx.QueryRow(ctx, "SELECT status, version FROM coffee_orders WHERE id = $1 FOR UPDATE", id).Scan(&from, &version)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return NotFoundError(fmt.Errorf("coffee order %d not found", id))
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := checkVersion(id, version, ifMatch); err != nil {
+			return err
+		}
+		if err := checkTransition(id, from, to); err != nil {
+			return err
+		}
+
+		query := "UPDATE coffee_orders SET status = $2, version = version + 1 WHERE id = $1 RETURNING id, user_name, coffee_type, status, version, created_at"
+		return tx.QueryRow(ctx, query, id, to).Scan(&order.ID, &order.UserName, &order.CoffeeType, &order.Status, &order.Version, &order.CreatedAt)
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	return &order, from, nil
+}
+
+// CoffeeTypeExists reports whether name is an active coffee type in the catalog
+func (db *Database) CoffeeTypeExists(ctx context.Context, name string) (bool, error) {
+	query := "SELECT EXISTS (SELECT 1 FROM coffee_types WHERE name = $1 AND active)"
+
+	var exists bool
+	if err := db.pool.QueryRow(ctx, query, name).Scan(&exists); err != nil {
+		return false, err
+	}
+	return exists, nil
+}
+
 // CreateCoffeeOrder creates a new coffee order
 func (db *Database) CreateCoffeeOrder(ctx context.Context, order CreateCoffeeOrder) (*CoffeeOrder, error) {
-	query := "INSERT INTO coffee_orders (user_name, coffee_type) VALUES ($1, $2) RETURNING id, user_name, coffee_type, created_at"
+	query := "INSERT INTO coffee_orders (user_name, coffee_type) VALUES ($1, $2) RETURNING id, user_name, coffee_type, status, version, created_at"
 
 	var createdOrder CoffeeOrder
 
-	err := db.pool.QueryRow(ctx, query, order.UserName, order.CoffeeType).Scan(&createdOrder.ID, &createdOrder.UserName, &createdOrder.CoffeeType, &createdOrder.CreatedAt)
+	err := db.pool.QueryRow(ctx, query, order.UserName, order.CoffeeType).Scan(&createdOrder.ID, &createdOrder.UserName, &createdOrder.CoffeeType, &createdOrder.Status, &createdOrder.Version, &createdOrder.CreatedAt)
 	if err != nil {
 		return nil, err
 	}
@@ -119,10 +204,10 @@ func (db *Database) CreateCoffeeOrder(ctx context.Context, order CreateCoffeeOrd
 
 // CreateCoffeeOrder creates a new coffee order
 func (db *Database) CreateCoffeeOrderInOneHour(ctx context.Context, order CreateCoffeeOrder) (*CoffeeOrder, error) {
-	query := "INSERT INTO coffee_orders (user_name, coffee_type, created_at) VALUES ($1, $2, $3) RETURNING id, user_name, coffee_type, created_at"
+	query := "INSERT INTO coffee_orders (user_name, coffee_type, created_at) VALUES ($1, $2, $3) RETURNING id, user_name, coffee_type, status, version, created_at"
 
 	var createdOrder CoffeeOrder
-	err := db.pool.QueryRow(ctx, query, order.UserName, order.CoffeeType, time.Now().Add(2*time.Hour)).Scan(&createdOrder.ID, &createdOrder.UserName, &createdOrder.CoffeeType, &createdOrder.CreatedAt)
+	err := db.pool.QueryRow(ctx, query, order.UserName, order.CoffeeType, time.Now().Add(2*time.Hour)).Scan(&createdOrder.ID, &createdOrder.UserName, &createdOrder.CoffeeType, &createdOrder.Status, &createdOrder.Version, &createdOrder.CreatedAt)
 	if err != nil {
 		return nil, err
 	}
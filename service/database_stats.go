@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// PoolStats is a snapshot of the connection pool statistics
+type PoolStats struct {
+	AcquiredConns        int32   `json:"acquired_conns"`
+	IdleConns            int32   `json:"idle_conns"`
+	TotalConns           int32   `json:"total_conns"`
+	MaxConns             int32   `json:"max_conns"`
+	AcquireCount         int64   `json:"acquire_count"`
+	EmptyAcquireCount    int64   `json:"empty_acquire_count"`
+	CanceledAcquireCount int64   `json:"canceled_acquire_count"`
+	AcquireDuration      float64 `json:"acquire_duration_seconds"`
+}
+
+// Stats returns the current connection pool statistics. The counts and the
+// acquire duration are cumulative since the pool was opened.
+func (db *Database) Stats() PoolStats {
+	stat := db.pool.Stat()
+	return PoolStats{
+		AcquiredConns:        stat.AcquiredConns(),
+		IdleConns:            stat.IdleConns(),
+		TotalConns:           stat.TotalConns(),
+		MaxConns:             stat.MaxConns(),
+		AcquireCount:         stat.AcquireCount(),
+		EmptyAcquireCount:    stat.EmptyAcquireCount(),
+		CanceledAcquireCount: stat.CanceledAcquireCount(),
+		AcquireDuration:      stat.AcquireDuration().Seconds(),
+	}
+}
+
+// poolStatsCollector periodically publishes the pool statistics through Metrics
+type poolStatsCollector struct {
+	db       *Database
+	metrics  *Metrics
+	interval time.Duration
+
+	done      chan struct{}
+	stopped   chan struct{}
+	closeOnce sync.Once
+}
+
+// startPoolStatsCollector publishes the pool statistics of db every interval
+// until the returned collector is closed
+func startPoolStatsCollector(db *Database, metrics *Metrics, interval time.Duration) *poolStatsCollector {
+	c := &poolStatsCollector{
+		db:       db,
+		metrics:  metrics,
+		interval: interval,
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	go c.run()
+	return c
+}
+
+// Close stops the collector and waits for the background goroutine to exit
+func (c *poolStatsCollector) Close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		<-c.stopped
+	})
+}
+
+func (c *poolStatsCollector) run() {
+	defer close(c.stopped)
+
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+
+	previous := c.db.Stats()
+	for {
+		select {
+		case <-ticker.C:
+			current := c.db.Stats()
+			c.metrics.sendPoolMetrics(context.Background(), current, previous)
+			previous = current
+		case <-c.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// ErrorKind classifies an application error and decides its HTTP status code
+type ErrorKind string
+
+const (
+	KindValidation           ErrorKind = "validation"
+	KindNotFound             ErrorKind = "not_found"
+	KindMethodNotAllowed     ErrorKind = "method_not_allowed"
+	KindConflict             ErrorKind = "conflict"
+	KindPreconditionFailed   ErrorKind = "precondition_failed"
+	KindPreconditionRequired ErrorKind = "precondition_required"
+	KindForbidden            ErrorKind = "forbidden"
+	KindBodyTooLarge         ErrorKind = "body_too_large"
+	KindOverloaded           ErrorKind = "overloaded"
+	KindUnavailable          ErrorKind = "unavailable"
+	KindInternal             ErrorKind = "internal"
+)
+
+// StatusCode returns the HTTP status code of errors of kind k
+func (k ErrorKind) StatusCode() int {
+	switch k {
+	case KindValidation:
+		return http.StatusBadRequest
+	case KindNotFound:
+		return http.StatusNotFound
+	case KindMethodNotAllowed:
+		return http.StatusMethodNotAllowed
+	case KindConflict:
+		return http.StatusConflict
+	case KindPreconditionFailed:
+		return http.StatusPreconditionFailed
+	case KindPreconditionRequired:
+		return http.StatusPreconditionRequired
+	case KindForbidden:
+		return http.StatusForbidden
+	case KindBodyTooLarge:
+		return http.StatusRequestEntityTooLarge
+	case KindOverloaded:
+		return http.StatusServiceUnavailable
+	case KindUnavailable:
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// AppError is an error with a kind. The kind is the error.type of the span and
+// the ErrorType dimension of the error metrics.
+type AppError struct {
+	Kind ErrorKind
+	Err  error
+}
+
+func (e *AppError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *AppError) Unwrap() error {
+	return e.Err
+}
+
+// ValidationError marks err as caused by an invalid request
+func ValidationError(err error) error {
+	return &AppError{Kind: KindValidation, Err: err}
+}
+
+// NotFoundError marks err as caused by a missing resource
+func NotFoundError(err error) error {
+	return &AppError{Kind: KindNotFound, Err: err}
+}
+
+// ConflictError marks err as caused by a conflict with the current state of a resource
+func ConflictError(err error) error {
+	return &AppError{Kind: KindConflict, Err: err}
+}
+
+// PreconditionFailedError marks err as caused by a request precondition that does not hold
+func PreconditionFailedError(err error) error {
+	return &AppError{Kind: KindPreconditionFailed, Err: err}
+}
+
+// PreconditionRequiredError marks err as caused by a request that lacks a required precondition
+func PreconditionRequiredError(err error) error {
+	return &AppError{Kind: KindPreconditionRequired, Err: err}
+}
+
+// ForbiddenError marks err as caused by a caller that may not use the endpoint
+func ForbiddenError(err error) error {
+	return &AppError{Kind: KindForbidden, Err: err}
+}
+
+// UnavailableError marks err as caused by a dependency that is temporarily unavailable
+func UnavailableError(err error) error {
+	return &AppError{Kind: KindUnavailable, Err: err}
+}
+
+// InternalError marks err as a server fault
+func InternalError(err error) error {
+	return &AppError{Kind: KindInternal, Err: err}
+}
+
+// errorKind returns the kind of err. Errors that were not created by one of the
+// constructors above are classified from the database errors they wrap;
+// anything else is internal.
+func errorKind(err error) ErrorKind {
+	var appErr *AppError
+	if errors.As(err, &appErr) {
+		return appErr.Kind
+	}
+
+	var pgErr *pgconn.PgError
+	var connectErr *pgconn.ConnectError
+	switch {
+	case errors.Is(err, pgx.ErrNoRows):
+		return KindNotFound
+	case errors.As(err, &pgErr) && pgErr.Code == "23505": // unique_violation
+		return KindConflict
+	case errors.As(err, &connectErr), pgconn.Timeout(err), errors.Is(err, context.DeadlineExceeded):
+		return KindUnavailable
+	default:
+		return KindInternal
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// orderETag returns the ETag of an order version, e.g. "3"
+func orderETag(version int) string {
+	return strconv.Quote(strconv.Itoa(version))
+}
+
+// IfMatch is the precondition of an If-Match header: any existing order for
+// "*", otherwise one of the listed order versions
+type IfMatch struct {
+	Any      bool
+	Versions []int
+}
+
+// Matches reports whether an order at version meets the precondition
+func (m IfMatch) Matches(version int) bool {
+	if m.Any {
+		return true
+	}
+	for _, v := range m.Versions {
+		if v == version {
+			return true
+		}
+	}
+	return false
+}
+
+// parseIfMatch parses an If-Match header, which updates must send so a
+// concurrent change is never overwritten. The header is "*" or a
+// comma-separated list of ETags, any of which may match. Weak ETags and ETags
+// that are not order versions never match, as If-Match uses the strong
+// comparison.
+func parseIfMatch(header string) (IfMatch, error) {
+	header = strings.TrimSpace(header)
+	if header == "" {
+		return IfMatch{}, PreconditionRequiredError(errors.New("If-Match is required, send the ETag of the order"))
+	}
+	if header == "*" {
+		return IfMatch{Any: true}, nil
+	}
+
+	var ifMatch IfMatch
+	listed := 0
+	for _, etag := range strings.Split(header, ",") {
+		etag = strings.TrimSpace(etag)
+		if etag == "" {
+			continue
+		}
+		listed++
+		if strings.HasPrefix(etag, "W/") {
+			continue
+		}
+
+		unquoted, err := strconv.Unquote(etag)
+		if err != nil || !strings.HasPrefix(etag, `"`) {
+			return IfMatch{}, ValidationError(fmt.Errorf("If-Match %s is not a quoted ETag", etag))
+		}
+		// Order versions are INTEGER columns, so larger values match no order
+		version, err := strconv.ParseInt(unquoted, 10, 32)
+		if err == nil && version > 0 {
+			ifMatch.Versions = append(ifMatch.Versions, int(version))
+		}
+	}
+	if listed == 0 {
+		return IfMatch{}, ValidationError(fmt.Errorf("If-Match %s lists no ETag", header))
+	}
+	return ifMatch, nil
+}
+
+// checkVersion returns a precondition failed error if the current version of
+// the order does not meet ifMatch
+func checkVersion(id int, version int, ifMatch IfMatch) error {
+	if !ifMatch.Matches(version) {
+		return PreconditionFailedError(fmt.Errorf("coffee order %d is at version %d, If-Match requires one of %v", id, version, ifMatch.Versions))
+	}
+	return nil
+}
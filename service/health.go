@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Health check statuses
+const (
+	HealthPass = "pass"
+	HealthFail = "fail"
+)
+
+// HealthCheck is a named dependency check. A failing critical check makes the
+// service not ready; a failing non-critical check is only reported.
+type HealthCheck struct {
+	Name     string
+	Check    func(ctx context.Context) error
+	Timeout  time.Duration
+	Critical bool
+	// CacheFor is how long a result is reused before the check runs again
+	CacheFor time.Duration
+}
+
+// HealthRegistry runs the registered checks for the readiness probe and
+// tracks whether startup has finished
+type HealthRegistry struct {
+	mu     sync.RWMutex
+	checks []*registeredCheck
+
+	started      atomic.Bool
+	shuttingDown atomic.Bool
+}
+
+// registeredCheck is a HealthCheck with its cached last result
+type registeredCheck struct {
+	HealthCheck
+
+	mu     sync.Mutex
+	last   HealthCheckResult
+	expiry time.Time
+}
+
+// NewHealthRegistry creates an empty HealthRegistry
+func NewHealthRegistry() *HealthRegistry {
+	return &HealthRegistry{}
+}
+
+// Register adds a check to the registry
+func (h *HealthRegistry) Register(check HealthCheck) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.checks = append(h.checks, &registeredCheck{HealthCheck: check})
+}
+
+// MarkStarted records that startup has finished, which makes the startup probe pass
+func (h *HealthRegistry) MarkStarted() {
+	h.started.Store(true)
+}
+
+// Started reports whether startup has finished
+func (h *HealthRegistry) Started() bool {
+	return h.started.Load()
+}
+
+// MarkShuttingDown makes the readiness probe fail, so the load balancer stops
+// sending new requests while the in-flight ones drain
+func (h *HealthRegistry) MarkShuttingDown() {
+	h.shuttingDown.Store(true)
+}
+
+// ShuttingDown reports whether shutdown has begun
+func (h *HealthRegistry) ShuttingDown() bool {
+	return h.shuttingDown.Load()
+}
+
+// Check runs all checks concurrently, reusing results that are still cached.
+// The overall status fails if any critical check fails.
+func (h *HealthRegistry) Check(ctx context.Context) HealthResponse {
+	h.mu.RLock()
+	checks := h.checks
+	h.mu.RUnlock()
+
+	results := make([]HealthCheckResult, len(checks))
+	var wg sync.WaitGroup
+	for i, check := range checks {
+		wg.Add(1)
+		go func(i int, check *registeredCheck) {
+			defer wg.Done()
+			results[i] = check.run(ctx)
+		}(i, check)
+	}
+	wg.Wait()
+
+	status := HealthPass
+	for _, result := range results {
+		if result.Critical && result.Status == HealthFail {
+			status = HealthFail
+		}
+	}
+
+	return HealthResponse{
+		Status:    status,
+		Timestamp: time.Now(),
+		Checks:    results,
+	}
+}
+
+// run returns the cached result or runs the check with its timeout. Concurrent
+// callers wait for a single run instead of each hitting the dependency.
+func (c *registeredCheck) run(ctx context.Context) HealthCheckResult {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	if now.Before(c.expiry) {
+		return c.last
+	}
+
+	// The result is shared with other callers, so a caller going away must not cancel the check
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), c.Timeout)
+	defer cancel()
+
+	err := c.Check(ctx)
+	result := HealthCheckResult{
+		Name:      c.Name,
+		Status:    HealthPass,
+		Critical:  c.Critical,
+		Duration:  time.Since(now).String(),
+		CheckedAt: now,
+	}
+	if err != nil {
+		result.Status = HealthFail
+		result.Error = err.Error()
+	}
+
+	c.last = result
+	c.expiry = now.Add(c.CacheFor)
+	return result
+}
+
+// databaseHealthCheck checks that the database answers a ping
+func databaseHealthCheck(db *Database) HealthCheck {
+	return HealthCheck{
+		Name:     "database",
+		Check:    db.Ping,
+		Timeout:  2 * time.Second,
+		Critical: true,
+		CacheFor: 5 * time.Second,
+	}
+}
+
+// schemaHealthCheck checks that every migration has been applied
+func schemaHealthCheck(migrator *Migrator) HealthCheck {
+	return HealthCheck{
+		Name:     "schema",
+		Check:    migrator.Ready,
+		Timeout:  2 * time.Second,
+		Critical: true,
+		CacheFor: 30 * time.Second,
+	}
+}
+
+// metricsBackendHealthCheck checks that a metrics backend with a remote API,
+// such as CloudWatch, is reachable. Metrics are not needed to serve requests,
+// so the check is not critical.
+func metricsBackendHealthCheck(name string, ping func(ctx context.Context) error) HealthCheck {
+	return HealthCheck{
+		Name:     name,
+		Check:    ping,
+		Timeout:  3 * time.Second,
+		Critical: false,
+		CacheFor: time.Minute,
+	}
+}
+
+// otlpHealthCheck checks that the OTLP collector accepts connections. Losing
+// telemetry does not stop the service from working, so the check is not critical.
+func otlpHealthCheck(endpoint string) HealthCheck {
+	return HealthCheck{
+		Name: "otlp_exporter",
+		Check: func(ctx context.Context) error {
+			address, err := endpointAddress(endpoint)
+			if err != nil {
+				return err
+			}
+			var dialer net.Dialer
+			conn, err := dialer.DialContext(ctx, "tcp", address)
+			if err != nil {
+				return err
+			}
+			return conn.Close()
+		},
+		Timeout:  time.Second,
+		Critical: false,
+		CacheFor: 30 * time.Second,
+	}
+}
+
+// endpointAddress returns the host:port of an OTLP endpoint URL
+func endpointAddress(endpoint string) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", fmt.Errorf("invalid OTLP endpoint %q: %w", endpoint, err)
+	}
+	if u.Host == "" {
+		return "", errors.New("OTLP endpoint has no host")
+	}
+	if u.Port() != "" {
+		return u.Host, nil
+	}
+	if u.Scheme == "https" {
+		return net.JoinHostPort(u.Hostname(), "443"), nil
+	}
+	return net.JoinHostPort(u.Hostname(), "80"), nil
+}
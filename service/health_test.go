@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingCheck returns a check that counts its runs and returns err
+func countingCheck(runs *atomic.Int32, err error) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		runs.Add(1)
+		return err
+	}
+}
+
+func TestHealthRegistryCachesResults(t *testing.T) {
+	var cached, uncached atomic.Int32
+	health := NewHealthRegistry()
+	health.Register(HealthCheck{Name: "cached", Check: countingCheck(&cached, nil), Timeout: time.Second, CacheFor: time.Hour})
+	health.Register(HealthCheck{Name: "uncached", Check: countingCheck(&uncached, nil), Timeout: time.Second})
+
+	// Concurrent probes share a run as well
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			health.Check(context.Background())
+		}()
+	}
+	wg.Wait()
+
+	if got := cached.Load(); got != 1 {
+		t.Errorf("cached check ran %d times, want 1", got)
+	}
+	if got := uncached.Load(); got != 10 {
+		t.Errorf("uncached check ran %d times, want 10", got)
+	}
+}
+
+func TestHealthRegistryTimesOutChecks(t *testing.T) {
+	health := NewHealthRegistry()
+	health.Register(HealthCheck{
+		Name: "hanging",
+		Check: func(ctx context.Context) error {
+			<-ctx.Done()
+			return ctx.Err()
+		},
+		Timeout:  10 * time.Millisecond,
+		Critical: true,
+	})
+
+	// A probe that goes away does not cancel the shared check; its timeout ends it
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	start := time.Now()
+	response := health.Check(ctx)
+
+	if elapsed := time.Since(start); elapsed < 10*time.Millisecond || elapsed > time.Second {
+		t.Errorf("check took %s, want its 10ms timeout", elapsed)
+	}
+	if response.Status != HealthFail || !strings.Contains(response.Checks[0].Error, context.DeadlineExceeded.Error()) {
+		t.Errorf("response = %+v, want the check failed with a deadline error", response)
+	}
+}
+
+func TestHealthRegistryOnlyCriticalFailuresFail(t *testing.T) {
+	down := errors.New("connection refused")
+	tests := []struct {
+		name       string
+		critical   error
+		optional   error
+		wantStatus string
+	}{
+		{name: "all pass", wantStatus: HealthPass},
+		{name: "non-critical fails", optional: down, wantStatus: HealthPass},
+		{name: "critical fails", critical: down, wantStatus: HealthFail},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var runs atomic.Int32
+			health := NewHealthRegistry()
+			health.Register(HealthCheck{Name: "database", Check: countingCheck(&runs, tt.critical), Timeout: time.Second, Critical: true})
+			health.Register(HealthCheck{Name: "cloudwatch", Check: countingCheck(&runs, tt.optional), Timeout: time.Second})
+
+			response := health.Check(context.Background())
+			if response.Status != tt.wantStatus {
+				t.Errorf("status = %s, want %s", response.Status, tt.wantStatus)
+			}
+			if len(response.Checks) != 2 || response.Checks[1].Critical || (tt.optional != nil) != (response.Checks[1].Status == HealthFail) {
+				t.Errorf("checks = %+v, want the cloudwatch result reported either way", response.Checks)
+			}
+		})
+	}
+}
+
+func TestHealthProbes(t *testing.T) {
+	app := newTestApp(t)
+	var runs atomic.Int32
+	var databaseUp atomic.Bool
+	app.health.Register(HealthCheck{
+		Name: "database",
+		Check: func(ctx context.Context) error {
+			runs.Add(1)
+			if !databaseUp.Load() {
+				return errors.New("connection refused")
+			}
+			return nil
+		},
+		Timeout:  time.Second,
+		Critical: true,
+	})
+
+	probe := func(path string) int {
+		return app.serve(httptest.NewRequest(http.MethodGet, path, nil)).Code
+	}
+	steps := []struct {
+		name    string
+		prepare func()
+		want    map[string]int
+	}{
+		{
+			name:    "starting",
+			prepare: func() {},
+			want:    map[string]int{"/livez": http.StatusOK, "/readyz": http.StatusServiceUnavailable, "/health": http.StatusServiceUnavailable, "/startupz": http.StatusServiceUnavailable},
+		},
+		{
+			// Migrations still run, so the task is not ready even once the database answers
+			name:    "database up before started",
+			prepare: func() { databaseUp.Store(true) },
+			want:    map[string]int{"/livez": http.StatusOK, "/readyz": http.StatusServiceUnavailable, "/startupz": http.StatusServiceUnavailable},
+		},
+		{
+			name:    "started",
+			prepare: app.health.MarkStarted,
+			want:    map[string]int{"/livez": http.StatusOK, "/readyz": http.StatusOK, "/health": http.StatusOK, "/startupz": http.StatusOK},
+		},
+		{
+			name:    "database down",
+			prepare: func() { databaseUp.Store(false) },
+			want:    map[string]int{"/livez": http.StatusOK, "/readyz": http.StatusServiceUnavailable, "/startupz": http.StatusOK},
+		},
+		{
+			name: "shutting down",
+			prepare: func() {
+				databaseUp.Store(true)
+				app.health.MarkShuttingDown()
+			},
+			want: map[string]int{"/livez": http.StatusOK, "/readyz": http.StatusServiceUnavailable, "/health": http.StatusServiceUnavailable, "/startupz": http.StatusOK},
+		},
+	}
+	for _, step := range steps {
+		step.prepare()
+		for path, want := range step.want {
+			if got := probe(path); got != want {
+				t.Errorf("%s: %s status = %d, want %d", step.name, path, got, want)
+			}
+		}
+	}
+
+	// Liveness never depends on the checks
+	before := runs.Load()
+	probe("/livez")
+	if runs.Load() != before {
+		t.Error("/livez ran the health checks")
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	metricnoop "go.opentelemetry.io/otel/metric/noop"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	tracenoop "go.opentelemetry.io/otel/trace/noop"
+)
+
+// newTestMetrics creates a Metrics that records to recorder, hashes user
+// names and limits the client-supplied dimensions like the default config
+func newTestMetrics(t *testing.T, recorder MetricsRecorder) *Metrics {
+	t.Helper()
+
+	redactor, err := NewRedactor(RedactHash, "test-salt", []string{"user_name"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	limiter := NewCardinalityLimiter(map[string]int{"UserName": 50, "CoffeeType": 20, "UnknownCoffeeType": 20}, nil, time.Hour, recorder, logger)
+
+	metrics, err := NewMetrics(recorder, limiter, redactor, metricnoop.NewMeterProvider().Meter("test"), tracenoop.NewTracerProvider().Tracer("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return metrics
+}
+
+// testApp is an App backed by in-memory orders and metrics, which keeps the
+// log lines and spans it records for assertions
+type testApp struct {
+	*App
+	router     http.Handler
+	repository *MemoryOrderRepository
+	recorder   *MemoryMetrics
+	spans      *tracetest.SpanRecorder
+	logs       *syncBuffer
+}
+
+// newTestApp creates a testApp with the routes of setupRoutes
+func newTestApp(t *testing.T) *testApp {
+	t.Helper()
+
+	redactor, err := NewRedactor(RedactHash, "test-salt", []string{"user_name"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logs := &syncBuffer{}
+	logLevel := new(slog.LevelVar)
+	logger := slog.New(NewContextHandler(slog.NewJSONHandler(logs, &slog.HandlerOptions{Level: slog.LevelDebug}), logLevel, redactor, false))
+
+	spans := tracetest.NewSpanRecorder()
+	tracer := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spans)).Tracer("test")
+
+	recorder := NewMemoryMetrics()
+	repository := NewMemoryOrderRepository()
+
+	app := &App{
+		orders:   repository,
+		health:   NewHealthRegistry(),
+		limits:   newRequestLimits(1<<20, 100, time.Second),
+		logger:   logger,
+		logLevel: logLevel,
+		metrics:  newTestMetrics(t, recorder),
+		redactor: redactor,
+		tracer:   tracer,
+	}
+
+	return &testApp{
+		App:        app,
+		router:     setupRoutes(app),
+		repository: repository,
+		recorder:   recorder,
+		spans:      spans,
+		logs:       logs,
+	}
+}
+
+// serve runs r through the router and returns the response
+func (a *testApp) serve(r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	a.router.ServeHTTP(w, r)
+	return w
+}
+
+// logLines returns the JSON log records written so far
+func (a *testApp) logLines(t *testing.T) []map[string]any {
+	t.Helper()
+	return a.logs.lines(t)
+}
+
+// lines parses the buffer as JSON log records
+func (b *syncBuffer) lines(t *testing.T) []map[string]any {
+	t.Helper()
+
+	var lines []map[string]any
+	scanner := bufio.NewScanner(bytes.NewReader(b.Bytes()))
+	for scanner.Scan() {
+		var line map[string]any
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			t.Fatalf("log line %q is not JSON: %v", scanner.Text(), err)
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// syncBuffer is a bytes.Buffer that handlers can write to concurrently
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) Bytes() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]byte(nil), b.buf.Bytes()...)
+}
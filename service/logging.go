@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"slices"
+	"syscall"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/baggage"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// debugLoggingKey marks a request context whose logs are emitted at debug level
+const debugLoggingKey contextKey = "debug_logging"
+
+// debugHeader enables debug logging for a single request
+const debugHeader = "X-Debug"
+
+// contextHandler is a slog.Handler that adds the request ID and the trace
+// context of the *Context logging call to every record, so any code path can
+// be correlated with its request and trace by logging with the request context.
+// It also decides which levels are enabled: the global level, lowered to debug
+// for requests that asked for debug logging.
+//
+// Groups are not passed on to the wrapped handler, which would nest
+// request_id and trace_id under them. They are kept in groups instead and
+// applied to the record attributes in Handle, so the correlation attributes
+// always stay at the top level.
+type contextHandler struct {
+	slog.Handler
+	level      slog.Leveler
+	redactor   *Redactor
+	spanEvents bool
+	attrs      []slog.Attr
+	groups     []handlerGroup
+}
+
+// handlerGroup is a group opened with WithGroup and the attributes added to it
+type handlerGroup struct {
+	name  string
+	attrs []slog.Attr
+}
+
+// NewContextHandler wraps handler with request and trace correlation. Records
+// below level are dropped unless the context enables debug logging, so handler
+// itself should accept every level. Sensitive attributes are redacted by
+// redactor, except in EMF records, whose dimensions are redacted when the
+// metrics build them. With spanEvents set, records logged while a span is
+// recording are also added to the span as events.
+func NewContextHandler(handler slog.Handler, level slog.Leveler, redactor *Redactor, spanEvents bool) slog.Handler {
+	return &contextHandler{Handler: handler, level: level, redactor: redactor, spanEvents: spanEvents}
+}
+
+func (h *contextHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	if level >= h.level.Level() {
+		return true
+	}
+	debug, _ := ctx.Value(debugLoggingKey).(bool)
+	return debug && level >= slog.LevelDebug
+}
+
+func (h *contextHandler) Handle(ctx context.Context, record slog.Record) error {
+	if len(h.groups) > 0 {
+		record = h.group(record)
+	}
+	// Span events are built from the attributes as logged, since the redacting
+	// span processor redacts them; redacting them here too would hash the hash
+	unredacted := record.Clone()
+	// The dimensions of EMF documents were already redacted by the metrics
+	// dimension builder, for the same reason
+	if record.Message != emfMessage {
+		record = h.redact(record)
+	}
+
+	var correlation []slog.Attr
+	if requestID := getRequestID(ctx); requestID != "" {
+		correlation = append(correlation, slog.String("request_id", requestID))
+	}
+
+	span := trace.SpanFromContext(ctx)
+	if spanContext := span.SpanContext(); spanContext.IsValid() {
+		correlation = append(correlation,
+			slog.String("trace_id", spanContext.TraceID().String()),
+			slog.String("span_id", spanContext.SpanID().String()),
+			slog.String("trace_flags", spanContext.TraceFlags().String()),
+		)
+	}
+	record.AddAttrs(correlation...)
+
+	// EMF documents are metrics, not log lines, so they are kept off the span
+	if h.spanEvents && span.IsRecording() && record.Message != emfMessage {
+		unredacted.AddAttrs(correlation...)
+		span.AddEvent(record.Message, trace.WithTimestamp(record.Time), trace.WithAttributes(recordAttributes(unredacted, h.attrs)...))
+	}
+
+	return h.Handler.Handle(ctx, record)
+}
+
+// WithAttrs keeps attrs as they are for span events, and passes them on
+// redacted to the wrapped handler, or redacts them in Handle once grouped
+func (h *contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	if len(attrs) == 0 {
+		return h
+	}
+
+	child := *h
+	if len(h.groups) == 0 {
+		child.Handler = h.Handler.WithAttrs(h.redactor.RedactAttrs(attrs))
+		child.attrs = append(slices.Clip(h.attrs), attrs...)
+		return &child
+	}
+
+	child.groups = slices.Clone(h.groups)
+	last := &child.groups[len(child.groups)-1]
+	last.attrs = append(slices.Clip(last.attrs), attrs...)
+	return &child
+}
+
+func (h *contextHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+
+	child := *h
+	child.groups = append(slices.Clip(h.groups), handlerGroup{name: name})
+	return &child
+}
+
+// group returns record with its attributes nested under the open groups,
+// together with the attributes added to each group
+func (h *contextHandler) group(record slog.Record) slog.Record {
+	var attrs []slog.Attr
+	record.Attrs(func(attr slog.Attr) bool {
+		attrs = append(attrs, attr)
+		return true
+	})
+
+	for i := len(h.groups) - 1; i >= 0; i-- {
+		group := h.groups[i]
+		members := append(slices.Clip(group.attrs), attrs...)
+		attrs = []slog.Attr{{Key: group.name, Value: slog.GroupValue(members...)}}
+	}
+
+	grouped := slog.NewRecord(record.Time, record.Level, record.Message, record.PC)
+	grouped.AddAttrs(attrs...)
+	return grouped
+}
+
+// redact returns record with its sensitive attributes redacted, including
+// those of its groups
+func (h *contextHandler) redact(record slog.Record) slog.Record {
+	attrs := make([]slog.Attr, 0, record.NumAttrs())
+	record.Attrs(func(attr slog.Attr) bool {
+		attrs = append(attrs, attr)
+		return true
+	})
+
+	redacted := slog.NewRecord(record.Time, record.Level, record.Message, record.PC)
+	redacted.AddAttrs(h.redactor.RedactAttrs(attrs)...)
+	return redacted
+}
+
+// recordAttributes converts the level and attributes of a log record, after
+// the handler attributes, into span event attributes. Group members are
+// flattened into dotted keys.
+func recordAttributes(record slog.Record, handlerAttrs []slog.Attr) []attribute.KeyValue {
+	attrs := make([]attribute.KeyValue, 0, len(handlerAttrs)+record.NumAttrs()+1)
+	attrs = append(attrs, attribute.String("log.severity", record.Level.String()))
+	for _, attr := range handlerAttrs {
+		attrs = appendAttribute(attrs, "", attr)
+	}
+	record.Attrs(func(attr slog.Attr) bool {
+		attrs = appendAttribute(attrs, "", attr)
+		return true
+	})
+	return attrs
+}
+
+// appendAttribute appends attr as a span attribute, prefixing its key
+func appendAttribute(attrs []attribute.KeyValue, prefix string, attr slog.Attr) []attribute.KeyValue {
+	attr.Value = attr.Value.Resolve()
+	if attr.Value.Kind() != slog.KindGroup {
+		return append(attrs, attribute.String(prefix+attr.Key, attr.Value.String()))
+	}
+	if attr.Key != "" {
+		prefix += attr.Key + "."
+	}
+	for _, member := range attr.Value.Group() {
+		attrs = appendAttribute(attrs, prefix, member)
+	}
+	return attrs
+}
+
+// withDebugLogging enables debug logging for the request context when the
+// request carries the X-Debug header or a debug=1 baggage member
+func withDebugLogging(ctx context.Context, r *http.Request) context.Context {
+	header := r.Header.Get(debugHeader)
+	if header == "1" || header == "true" || baggage.FromContext(ctx).Member("debug").Value() == "1" {
+		return context.WithValue(ctx, debugLoggingKey, true)
+	}
+	return ctx
+}
+
+// handleLogLevelSignals switches the global level to debug on SIGUSR1 and
+// back to defaultLevel on SIGUSR2
+func handleLogLevelSignals(level *slog.LevelVar, defaultLevel slog.Level, logger *slog.Logger) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1, syscall.SIGUSR2)
+
+	go func() {
+		for sig := range signals {
+			if sig == syscall.SIGUSR1 {
+				level.Set(slog.LevelDebug)
+			} else {
+				level.Set(defaultLevel)
+			}
+			logger.Info("Log level changed", "level", level.Level().String(), "signal", sig.String())
+		}
+	}()
+}
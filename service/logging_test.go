@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"testing"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestContextHandlerKeepsCorrelationAttrsTopLevel(t *testing.T) {
+	redactor, err := NewRedactor(RedactHash, "test-salt", []string{"user_name"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	logs := &syncBuffer{}
+	logger := slog.New(NewContextHandler(slog.NewJSONHandler(logs, nil), slog.LevelInfo, redactor, true))
+
+	spans := tracetest.NewSpanRecorder()
+	tracer := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spans)).Tracer("test")
+	ctx, span := tracer.Start(context.WithValue(context.Background(), requestIDKey, "req-1"), "query")
+
+	logger.With("component", "db").WithGroup("query").With("table", "orders").InfoContext(ctx, "Query done", "rows", 3, "user_name", "alice")
+	span.End()
+
+	var line map[string]any
+	if err := json.Unmarshal(logs.Bytes(), &line); err != nil {
+		t.Fatalf("log line %q is not JSON: %v", logs.Bytes(), err)
+	}
+	if line["request_id"] != "req-1" {
+		t.Errorf("request_id = %v, want req-1 at the top level: %s", line["request_id"], logs.Bytes())
+	}
+	if line["trace_id"] != span.SpanContext().TraceID().String() {
+		t.Errorf("trace_id = %v, want %s at the top level", line["trace_id"], span.SpanContext().TraceID())
+	}
+	if line["component"] != "db" {
+		t.Errorf("component = %v, want db", line["component"])
+	}
+	query, _ := line["query"].(map[string]any)
+	if query["table"] != "orders" || query["rows"] != float64(3) {
+		t.Errorf("query group = %v, want table and rows", line["query"])
+	}
+	if name, _ := query["user_name"].(string); name == "" || name == "alice" {
+		t.Errorf("query.user_name = %q, want a redacted value", name)
+	}
+
+	events := spans.Ended()[0].Events()
+	if len(events) != 1 {
+		t.Fatalf("span has %d events, want 1", len(events))
+	}
+	attrs := map[string]string{}
+	for _, attr := range events[0].Attributes {
+		attrs[string(attr.Key)] = attr.Value.Emit()
+	}
+	for key, want := range map[string]string{"component": "db", "query.table": "orders", "query.rows": "3"} {
+		if attrs[key] != want {
+			t.Errorf("span event attribute %s = %q, want %q", key, attrs[key], want)
+		}
+	}
+}
+
+// TestSpanEventUserNameMatchesLogLine checks that a user name is redacted once
+// on its way to the log line and once on its way to the exported span event,
+// so both carry the same token
+func TestSpanEventUserNameMatchesLogLine(t *testing.T) {
+	redactor, err := NewRedactor(RedactHash, "test-salt", []string{"user_name"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	logs := &syncBuffer{}
+	logger := slog.New(NewContextHandler(slog.NewJSONHandler(logs, nil), slog.LevelInfo, redactor, true))
+
+	spans := tracetest.NewSpanRecorder()
+	tracer := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(newRedactingSpanProcessor(spans, redactor))).Tracer("test")
+	ctx, span := tracer.Start(context.Background(), "create order")
+
+	logger.With("user_name", "alice").InfoContext(ctx, "Order created")
+	logger.WithGroup("order").InfoContext(ctx, "Order created", "user_name", "bob")
+	span.End()
+
+	want := map[string]string{"alice": "user_name", "bob": "order.user_name"}
+	lines := logs.lines(t)
+	events := spans.Ended()[0].Events()
+	if len(lines) != 2 || len(events) != 2 {
+		t.Fatalf("logged %d lines and %d span events, want 2 of each", len(lines), len(events))
+	}
+	for i, name := range []string{"alice", "bob"} {
+		token, _ := redactor.Redact(name)
+
+		logged, _ := lines[i]["user_name"].(string)
+		if order, ok := lines[i]["order"].(map[string]any); ok {
+			logged, _ = order["user_name"].(string)
+		}
+		var event string
+		for _, attr := range events[i].Attributes {
+			if string(attr.Key) == want[name] {
+				event = attr.Value.AsString()
+			}
+		}
+		if logged != token || event != token {
+			t.Errorf("%s is %q in the log line and %q in the span event, want %q in both", name, logged, event, token)
+		}
+	}
+}
@@ -2,33 +2,51 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net/http"
 	"os"
-
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/cloudwatch"
 )
 
 func main() {
-	// Initialize logger
-	logger := slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{
-		Level: slog.LevelInfo,
-	}))
-	slog.SetDefault(logger)
-
 	// Load configuration
 	config := LoadConfig()
+	if err := config.Validate(); err != nil {
+		slog.Error("Invalid configuration", "error", err)
+		os.Exit(1)
+	}
 
-	// Initialize OpenTelemetry
-	tracer, cleanup, err := initTracing()
+	// Initialize the redactor shared by logs, traces and metrics
+	redactor, err := NewRedactor(config.PIIRedaction, config.PIIRedactionSalt, config.PIIKeys)
+	if err != nil {
+		slog.Error("Failed to initialize PII redaction", "error", err)
+		os.Exit(1)
+	}
+
+	// Initialize logger that correlates every *Context call with its request and trace.
+	// The level can be changed at runtime and lowered per request, so the JSON
+	// handler accepts everything and the context handler does the filtering.
+	logLevel := new(slog.LevelVar)
+	logLevel.Set(config.LogLevel)
+	logger := slog.New(NewContextHandler(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{
+		Level: slog.LevelDebug,
+	}), logLevel, redactor, config.LogSpanEvents))
+	slog.SetDefault(logger)
+	handleLogLevelSignals(logLevel, config.LogLevel, logger)
+
+	// Initialize OpenTelemetry tracing and metrics
+	tracer, tracingCleanup, err := initTracing(config, redactor)
 	if err != nil {
 		logger.Error("Failed to initialize tracing", "error", err)
 		os.Exit(1)
 	}
-	defer cleanup()
+
+	meter, metricsCleanup, err := initMetrics()
+	if err != nil {
+		logger.Error("Failed to initialize OpenTelemetry metrics", "error", err)
+		os.Exit(1)
+	}
 
 	// Initialize database connection with pgx
 	dsn := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=require",
@@ -39,47 +57,128 @@ func main() {
 		logger.Error("Failed to connect to database", "error", err)
 		os.Exit(1)
 	}
-	defer db.Close()
 
-	// Initialize AWS CloudWatch
-	sess, err := session.NewSession(&aws.Config{
-		Region: aws.String(config.Region),
-	})
+	migrator, err := NewMigrator(db, logger, tracer)
+	if err != nil {
+		logger.Error("Failed to load migrations", "error", err)
+		os.Exit(1)
+	}
+
+	// "migrate" runs the migration subcommand instead of the server
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		code := runMigrate(context.Background(), migrator, os.Args[2:], logger)
+		db.Close()
+		if err := tracingCleanup(context.Background()); err != nil {
+			logger.Error("Failed to flush traces", "error", err)
+		}
+		os.Exit(code)
+	}
+
+	// Initialize metrics backend
+	recorder, err := NewMetricsRecorder(config, logger)
 	if err != nil {
-		logger.Error("Failed to create AWS session", "error", err)
+		logger.Error("Failed to initialize metrics backend", "error", err)
 		os.Exit(1)
 	}
-	cw := cloudwatch.New(sess)
 
 	// Create metrics instance
-	metrics := &CloudWatchMetrics{
-		cw:     cw,
-		logger: logger,
-		tracer: tracer,
+	limiter := NewCardinalityLimiter(config.MetricsDimensionLimits, config.MetricsDimensionAllowlists, config.MetricsDimensionWindow, recorder, logger)
+	metrics, err := NewMetrics(recorder, limiter, redactor, meter, tracer)
+	if err != nil {
+		logger.Error("Failed to initialize metrics", "error", err)
+		os.Exit(1)
+	}
+
+	// Publish connection pool statistics in the background
+	poolStats := startPoolStatsCollector(db, metrics, config.DBPoolStatsInterval)
+
+	// Publish Go runtime statistics in the background
+	runtimeStats := startRuntimeStatsCollector(metrics, config.RuntimeStatsInterval)
+
+	// Register the dependency checks behind the readiness probe
+	health := NewHealthRegistry()
+	health.Register(databaseHealthCheck(db))
+	health.Register(schemaHealthCheck(migrator))
+	health.Register(otlpHealthCheck(config.OTLPEndpoint))
+	if pinger, ok := recorder.(interface{ Ping(context.Context) error }); ok {
+		health.Register(metricsBackendHealthCheck("metrics_"+config.MetricsBackend, pinger.Ping))
 	}
 
 	// Create app instance
 	app := &App{
-		db:      db,
-		logger:  logger,
-		metrics: metrics,
-		region:  config.Region,
-		tracer:  tracer,
+		db:         db,
+		orders:     db,
+		health:     health,
+		limits:     newRequestLimits(int64(config.HTTPMaxBodyBytes), config.HTTPMaxInFlight, config.HTTPShedRetryAfter),
+		adminToken: config.AdminToken,
+		logger:     logger,
+		logLevel:   logLevel,
+		metrics:    metrics,
+		redactor:   redactor,
+		region:     config.Region,
+		tracer:     tracer,
+		xray:       config.XRayTracing,
 	}
 
-	// Initialize database schema
-	if err := app.initSchema(); err != nil {
-		logger.Error("Failed to initialize database schema", "error", err)
-		os.Exit(1)
+	// Apply pending migrations, unless they are run separately with "migrate up".
+	// This runs once the server is listening, so the startup probe reports the
+	// migrations as in progress instead of the connection being refused.
+	startup := func(ctx context.Context) error {
+		if config.MigrateOnStart {
+			if err := migrator.Up(ctx); err != nil {
+				return fmt.Errorf("failed to migrate database schema: %w", err)
+			}
+		}
+		health.MarkStarted()
+		logger.Info("Startup completed")
+		return nil
 	}
 
 	router := setupRoutes(app)
 
-	// Start server
+	// The idle timeout outlasts the ALB's 60s idle timeout, so the ALB never
+	// reuses a connection the server has just closed
+	server := &http.Server{
+		Addr:              ":" + config.Port,
+		Handler:           router,
+		ReadHeaderTimeout: config.HTTPReadHeaderTimeout,
+		ReadTimeout:       config.HTTPReadTimeout,
+		WriteTimeout:      config.HTTPWriteTimeout,
+		IdleTimeout:       config.HTTPIdleTimeout,
+	}
+
+	// Start server and block until it fails or ECS sends SIGTERM
 	logger.Info("Starting server", "port", config.Port)
 
-	if err := http.ListenAndServe(":"+config.Port, router); err != nil {
-		logger.Error("Server failed to start", "error", err)
+	if err := serve(server, logger, startup); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		logger.Error("Server failed", "error", err)
+		// Export the spans that explain the failure, such as those of a failed
+		// startup migration, before exiting
+		ctx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+		if err := tracingCleanup(ctx); err != nil {
+			logger.Error("Failed to flush traces", "error", err)
+		}
+		cancel()
+		db.Close()
+		os.Exit(1)
+	}
+
+	// Stop taking traffic, finish the in-flight requests and metric goroutines,
+	// then flush the buffered telemetry. The pool closes last because the pool
+	// collector and in-flight requests use it.
+	err = shutdown(logger, drain(health, config.ShutdownDrainPeriod), config.ShutdownTimeout,
+		shutdownPhase{name: "http_server", run: server.Shutdown},
+		shutdownPhase{name: "metric_goroutines", run: metrics.Wait},
+		closePhase("runtime_stats_collector", runtimeStats.Close),
+		closePhase("pool_stats_collector", poolStats.Close),
+		closePhase("metrics_backend", metrics.Close),
+		shutdownPhase{name: "meter_provider", run: metricsCleanup},
+		shutdownPhase{name: "tracer_provider", run: tracingCleanup},
+		closePhase("database_pool", db.Close),
+	)
+	if err != nil {
+		logger.Error("Shutdown completed with errors", "error", err)
 		os.Exit(1)
 	}
+	logger.Info("Shutdown completed")
 }
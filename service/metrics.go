@@ -2,122 +2,337 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"go.opentelemetry.io/otel/metric"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
 	"go.opentelemetry.io/otel/trace"
 )
 
-// CloudWatchMetrics handles CloudWatch metrics operations
-type CloudWatchMetrics struct {
-	cw     *cloudwatch.CloudWatch
-	logger *slog.Logger
-	tracer trace.Tracer
+const MetricsNamespace = "GoObservabilityDemo/Application"
+
+// unmatchedEndpoint is the Endpoint dimension of requests that match no route.
+// CloudWatch rejects empty dimension values.
+const unmatchedEndpoint = "unmatched"
+
+// Unit is the unit of a recorded value. The values match the CloudWatch standard units.
+type Unit string
+
+const (
+	UnitCount          Unit = "Count"
+	UnitSeconds        Unit = "Seconds"
+	UnitBytes          Unit = "Bytes"
+	UnitBytesPerSecond Unit = "Bytes/Second"
+	UnitNone           Unit = "None"
+)
+
+// Dimension is a name/value pair that qualifies a metric
+type Dimension struct {
+	Name  string
+	Value string
 }
 
-const MetricsNamespace = "GoObservabilityDemo/Application"
+// MetricsRecorder is implemented by every metrics backend. The context carries
+// the request and trace IDs for backends that attach them to recorded values.
+type MetricsRecorder interface {
+	// Counter adds value to a monotonically increasing count
+	Counter(ctx context.Context, name string, value float64, dims ...Dimension)
+	// Histogram records a single observation of a distribution
+	Histogram(ctx context.Context, name string, value float64, unit Unit, dims ...Dimension)
+	// Gauge records the current value of a quantity that can go up and down
+	Gauge(ctx context.Context, name string, value float64, unit Unit, dims ...Dimension)
+	// Close flushes anything the backend still buffers
+	Close()
+}
+
+// Metrics records the application's route and business metrics through a
+// MetricsRecorder and the OpenTelemetry meter
+type Metrics struct {
+	recorder MetricsRecorder
+	limiter  *CardinalityLimiter
+	redactor *Redactor
+	otel     *otelInstruments
+	tracer   trace.Tracer
+
+	// inflight tracks the metric goroutines still running, so shutdown can wait
+	// for them. closed is set by Wait; mu makes sure no goroutine is added once
+	// Wait has started, which sync.WaitGroup does not allow.
+	mu       sync.Mutex
+	closed   bool
+	inflight sync.WaitGroup
+}
+
+// NewMetrics creates a Metrics instance backed by recorder and meter. User-supplied
+// dimension values are redacted by redactor and bounded by limiter.
+func NewMetrics(recorder MetricsRecorder, limiter *CardinalityLimiter, redactor *Redactor, meter metric.Meter, tracer trace.Tracer) (*Metrics, error) {
+	instruments, err := newOTelInstruments(meter)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OpenTelemetry instruments: %w", err)
+	}
+
+	return &Metrics{
+		recorder: recorder,
+		limiter:  limiter,
+		redactor: redactor,
+		otel:     instruments,
+		tracer:   tracer,
+	}, nil
+}
+
+// NewMetricsRecorder creates the metrics backend selected by config.MetricsBackend
+func NewMetricsRecorder(config *Config, logger *slog.Logger) (MetricsRecorder, error) {
+	switch config.MetricsBackend {
+	case "cloudwatch":
+		sess, err := session.NewSession(&aws.Config{
+			Region: aws.String(config.Region),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to create AWS session: %w", err)
+		}
+		return NewCloudWatchMetrics(cloudwatch.New(sess), config.MetricsFlushInterval, config.MetricsQueueSize, logger), nil
+	case "prometheus":
+		return NewPrometheusMetrics(), nil
+	case "emf":
+		return NewEMFMetrics(MetricsNamespace, logger), nil
+	case "memory":
+		return NewMemoryMetrics(), nil
+	default:
+		return nil, fmt.Errorf("unknown metrics backend %q", config.MetricsBackend)
+	}
+}
+
+// Close flushes the underlying metrics backend
+func (m *Metrics) Close() {
+	m.recorder.Close()
+}
+
+// sendRouteMetrics records request duration and count for a route, and an error
+// count for responses with a 4xx or 5xx status. errorType is the kind of error
+// the response reported, empty for successful responses. The _ByStatusClass
+// metrics break the per-endpoint ones down by method and status class.
+func (m *Metrics) sendRouteMetrics(ctx context.Context, method string, endpoint string, statusCode int, errorType string, duration time.Duration) {
+	method = normalizeMethod(method)
+	m.otel.recordRequest(ctx, method, endpoint, statusCode, errorType, duration)
 
-// sendRouteMetrics sends route metrics to CloudWatch
-func (m *CloudWatchMetrics) sendRouteMetrics(ctx context.Context, endpoint string, duration time.Duration) {
 	ctx, span := m.tracer.Start(ctx, "metrics.sendRouteMetrics")
 	defer span.End()
 
-	metrics := []*cloudwatch.MetricDatum{
-		{
-			MetricName: aws.String("RequestDuration"),
-			Value:      aws.Float64(duration.Seconds()),
-			Unit:       aws.String("Seconds"),
-			Dimensions: []*cloudwatch.Dimension{},
-			Timestamp:  aws.Time(time.Now()),
-		},
-		{
-			MetricName: aws.String("RequestDuration"),
-			Value:      aws.Float64(duration.Seconds()),
-			Unit:       aws.String("Seconds"),
-			Dimensions: []*cloudwatch.Dimension{
-				{
-					Name:  aws.String("Endpoint"),
-					Value: aws.String(endpoint),
-				},
-			},
-			Timestamp: aws.Time(time.Now()),
-		},
-		{
-			MetricName: aws.String("RequestCount"),
-			Value:      aws.Float64(1),
-			Unit:       aws.String("Count"),
-			Dimensions: []*cloudwatch.Dimension{},
-			Timestamp:  aws.Time(time.Now()),
-		},
-		{
-			MetricName: aws.String("RequestCount_ByEndpoint"),
-			Value:      aws.Float64(1),
-			Unit:       aws.String("Count"),
-			Dimensions: []*cloudwatch.Dimension{
-				{
-					Name:  aws.String("Endpoint"),
-					Value: aws.String(endpoint),
-				},
-			},
-			Timestamp: aws.Time(time.Now()),
-		},
+	if endpoint == "" {
+		endpoint = unmatchedEndpoint
+	}
+	endpointDim := Dimension{Name: "Endpoint", Value: endpoint}
+	dims := []Dimension{
+		endpointDim,
+		{Name: "Method", Value: method},
+		{Name: "StatusClass", Value: statusClass(statusCode)},
 	}
 
-	_, err := m.cw.PutMetricData(&cloudwatch.PutMetricDataInput{
-		Namespace:  aws.String(MetricsNamespace),
-		MetricData: metrics,
-	})
-	if err != nil {
-		m.logger.Error("Failed to send CloudWatch metrics", "error", err)
+	m.recorder.Histogram(ctx, "RequestDuration", duration.Seconds(), UnitSeconds)
+	m.recorder.Histogram(ctx, "RequestDuration", duration.Seconds(), UnitSeconds, endpointDim)
+	m.recorder.Histogram(ctx, "RequestDuration_ByStatusClass", duration.Seconds(), UnitSeconds, dims...)
+	m.recorder.Counter(ctx, "RequestCount", 1)
+	m.recorder.Counter(ctx, "RequestCount_ByEndpoint", 1, endpointDim)
+	m.recorder.Counter(ctx, "RequestCount_ByStatusClass", 1, dims...)
+
+	if statusCode >= 400 {
+		if errorType == "" {
+			errorType = strconv.Itoa(statusCode)
+		}
+		m.recorder.Counter(ctx, "RequestErrors", 1)
+		m.recorder.Counter(ctx, "RequestErrors", 1, dims...)
+		m.recorder.Counter(ctx, "RequestErrors_ByType", 1, Dimension{Name: "ErrorType", Value: errorType})
 	}
 }
 
-// sendCreatedCoffeeOrderMetrics sends coffee order creation metrics to CloudWatch
-func (m *CloudWatchMetrics) sendCreatedCoffeeOrderMetrics(ctx context.Context, coffeeType string, userName string) {
+// Wait blocks until the metric goroutines started by the *Async methods have
+// finished, or returns the context error if ctx is done first. Metrics sent
+// asynchronously after Wait has been called are dropped.
+func (m *Metrics) Wait(ctx context.Context) error {
+	m.mu.Lock()
+	m.closed = true
+	m.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		m.inflight.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// sendCreatedCoffeeOrderMetricsAsync records coffee order creation metrics in
+// the background. The goroutine outlives the request, so it keeps the request's
+// trace context but not its cancellation. Once shutdown has begun the metrics
+// are dropped, since nothing would wait for them to be published.
+func (m *Metrics) sendCreatedCoffeeOrderMetricsAsync(ctx context.Context, coffeeType string, userName string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return
+	}
+
+	m.inflight.Add(1)
+	go func() {
+		defer m.inflight.Done()
+		m.sendCreatedCoffeeOrderMetrics(context.WithoutCancel(ctx), coffeeType, userName)
+	}()
+}
+
+// sendRejectedRequestMetrics counts a request rejected before its handler ran,
+// because the server was overloaded or the body was too large
+func (m *Metrics) sendRejectedRequestMetrics(ctx context.Context, endpoint string, reason ErrorKind) {
+	if endpoint == "" {
+		endpoint = unmatchedEndpoint
+	}
+	m.recorder.Counter(ctx, "RequestsRejected_Total", 1)
+	m.recorder.Counter(ctx, "RequestsRejected_ByReason", 1,
+		Dimension{Name: "Endpoint", Value: endpoint},
+		Dimension{Name: "Reason", Value: string(reason)},
+	)
+}
+
+// trackActiveRequest counts a request as active until the returned function is called
+func (m *Metrics) trackActiveRequest(ctx context.Context, method string) func() {
+	method = normalizeMethod(method)
+	m.otel.activeRequests.Add(ctx, 1, metric.WithAttributes(semconv.HTTPRequestMethodKey.String(method)))
+	return func() {
+		m.otel.activeRequests.Add(ctx, -1, metric.WithAttributes(semconv.HTTPRequestMethodKey.String(method)))
+	}
+}
+
+// sendUnknownCoffeeTypeMetrics counts an order rejected because its coffee
+// type is not in the catalog. Unknown types are chosen by the client, so they
+// have their own dimension and limit; sharing the CoffeeType slots would let
+// junk types push menu items out of CreatedCoffeeOrders_ByType.
+func (m *Metrics) sendUnknownCoffeeTypeMetrics(ctx context.Context, coffeeType string) {
+	coffeeTypeDim, _ := m.dimension(ctx, "UnknownCoffeeType", coffeeType)
+
+	m.recorder.Counter(ctx, "UnknownCoffeeTypeOrders_Total", 1)
+	m.recorder.Counter(ctx, "UnknownCoffeeTypeOrders_ByType", 1, coffeeTypeDim)
+}
+
+// sendOrderStatusTransitionMetrics counts an order moving from one state to another
+func (m *Metrics) sendOrderStatusTransitionMetrics(ctx context.Context, from OrderStatus, to OrderStatus) {
+	m.recorder.Counter(ctx, "OrderStatusTransitions", 1,
+		Dimension{Name: "From", Value: string(from)},
+		Dimension{Name: "To", Value: string(to)},
+	)
+}
+
+// sendOrderUpdateConflictMetrics counts an order update refused because of a
+// concurrent change (precondition_failed) or an illegal transition (conflict)
+func (m *Metrics) sendOrderUpdateConflictMetrics(ctx context.Context, kind ErrorKind) {
+	m.recorder.Counter(ctx, "OrderUpdateConflicts_Total", 1)
+	m.recorder.Counter(ctx, "OrderUpdateConflicts_ByType", 1, Dimension{Name: "ErrorType", Value: string(kind)})
+}
+
+// sendCreatedCoffeeOrderMetrics records coffee order creation metrics
+func (m *Metrics) sendCreatedCoffeeOrderMetrics(ctx context.Context, coffeeType string, userName string) {
 	ctx, span := m.tracer.Start(ctx, "metrics.sendCreatedCoffeeOrderMetrics")
 	defer span.End()
 
-	metrics := []*cloudwatch.MetricDatum{
-		{
-			MetricName: aws.String("CreatedCoffeeOrders_Total"),
-			Value:      aws.Float64(1),
-			Unit:       aws.String("Count"),
-			Dimensions: []*cloudwatch.Dimension{},
-			Timestamp:  aws.Time(time.Now()),
-		},
-		{
-			MetricName: aws.String("CreatedCoffeeOrders_ByType"),
-			Value:      aws.Float64(1),
-			Unit:       aws.String("Count"),
-			Dimensions: []*cloudwatch.Dimension{
-				{
-					Name:  aws.String("CoffeeType"),
-					Value: aws.String(coffeeType),
-				},
-			},
-			Timestamp: aws.Time(time.Now()),
-		},
-		{
-			MetricName: aws.String("CreatedCoffeeOrders_ByName"),
-			Value:      aws.Float64(1),
-			Unit:       aws.String("Count"),
-			Dimensions: []*cloudwatch.Dimension{
-				{
-					Name:  aws.String("UserName"),
-					Value: aws.String(userName),
-				},
-			},
-			Timestamp: aws.Time(time.Now()),
-		},
+	// Both values come straight from the client, so they go through the dimension builder
+	coffeeTypeDim, _ := m.dimension(ctx, "CoffeeType", coffeeType)
+	userNameDim, userNameOK := m.dimension(ctx, "UserName", userName)
+
+	m.otel.recordOrder(ctx, coffeeTypeDim.Value)
+
+	m.recorder.Counter(ctx, "CreatedCoffeeOrders_Total", 1)
+	m.recorder.Counter(ctx, "CreatedCoffeeOrders_ByType", 1, coffeeTypeDim)
+	if userNameOK {
+		m.recorder.Counter(ctx, "CreatedCoffeeOrders_ByName", 1, userNameDim)
 	}
+}
 
-	_, err := m.cw.PutMetricData(&cloudwatch.PutMetricDataInput{
-		Namespace:  aws.String(MetricsNamespace),
-		MetricData: metrics,
-	})
-	if err != nil {
-		m.logger.Error("Failed to send created coffee order metric to CloudWatch", "error", err)
+// dimension builds a dimension from a client-supplied value, redacting it if
+// name is sensitive and collapsing it if it exceeds the cardinality limit. It
+// returns false if the redaction policy drops the value.
+func (m *Metrics) dimension(ctx context.Context, name string, value string) (Dimension, bool) {
+	if m.redactor.Sensitive(name) {
+		redacted, ok := m.redactor.Redact(value)
+		if !ok {
+			return Dimension{}, false
+		}
+		value = redacted
+	}
+	return m.limiter.Dimension(ctx, name, value), true
+}
+
+// sendPoolMetrics records connection pool gauges. The cumulative counts are
+// published as the change since the previous snapshot, and the acquire duration
+// as the average wait per acquire in that period.
+func (m *Metrics) sendPoolMetrics(ctx context.Context, current PoolStats, previous PoolStats) {
+	m.recorder.Gauge(ctx, "DBPool_AcquiredConns", float64(current.AcquiredConns), UnitCount)
+	m.recorder.Gauge(ctx, "DBPool_IdleConns", float64(current.IdleConns), UnitCount)
+	m.recorder.Gauge(ctx, "DBPool_TotalConns", float64(current.TotalConns), UnitCount)
+	m.recorder.Gauge(ctx, "DBPool_MaxConns", float64(current.MaxConns), UnitCount)
+	m.recorder.Gauge(ctx, "DBPool_EmptyAcquires", float64(current.EmptyAcquireCount-previous.EmptyAcquireCount), UnitCount)
+	m.recorder.Gauge(ctx, "DBPool_CanceledAcquires", float64(current.CanceledAcquireCount-previous.CanceledAcquireCount), UnitCount)
+
+	if acquires := current.AcquireCount - previous.AcquireCount; acquires > 0 {
+		wait := (current.AcquireDuration - previous.AcquireDuration) / float64(acquires)
+		m.recorder.Gauge(ctx, "DBPool_AcquireDuration", wait, UnitSeconds)
+	}
+}
+
+// sendRuntimeMetrics records Go runtime gauges, tagged with the service
+// metadata of the telemetry resource
+func (m *Metrics) sendRuntimeMetrics(ctx context.Context, stats RuntimeStats) {
+	dims := []Dimension{
+		{Name: "ServiceName", Value: serviceName},
+		{Name: "ServiceVersion", Value: serviceVersion},
+		{Name: "Environment", Value: deploymentEnvironment},
+	}
+
+	m.recorder.Gauge(ctx, "Runtime_HeapInUse", stats.HeapInUse, UnitBytes, dims...)
+	m.recorder.Gauge(ctx, "Runtime_AllocRate", stats.AllocRate, UnitBytesPerSecond, dims...)
+	m.recorder.Gauge(ctx, "Runtime_Goroutines", stats.Goroutines, UnitCount, dims...)
+	m.recorder.Gauge(ctx, "Runtime_GCCycles", stats.GCCycles, UnitCount, dims...)
+	m.recorder.Gauge(ctx, "Runtime_GCPauseP50", stats.GCPauseP50, UnitSeconds, dims...)
+	m.recorder.Gauge(ctx, "Runtime_GCPauseP99", stats.GCPauseP99, UnitSeconds, dims...)
+	m.recorder.Gauge(ctx, "Runtime_GCPauseMax", stats.GCPauseMax, UnitSeconds, dims...)
+}
+
+// statusClass returns the class of an HTTP status code, such as "2xx" or "5xx"
+func statusClass(statusCode int) string {
+	return fmt.Sprintf("%dxx", statusCode/100)
+}
+
+// knownMethods are the HTTP methods recorded as they are
+var knownMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodPost:    true,
+	http.MethodPut:     true,
+	http.MethodPatch:   true,
+	http.MethodDelete:  true,
+	http.MethodConnect: true,
+	http.MethodOptions: true,
+	http.MethodTrace:   true,
+}
+
+// otherMethod replaces unknown methods, as the HTTP semantic conventions require
+const otherMethod = "_OTHER"
+
+// normalizeMethod returns method if it is a known HTTP method and _OTHER
+// otherwise, so clients cannot create metric series with made-up methods
+func normalizeMethod(method string) string {
+	if knownMethods[method] {
+		return method
 	}
+	return otherMethod
 }
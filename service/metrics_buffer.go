@@ -0,0 +1,332 @@
+package main
+
+import (
+	"log/slog"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/cloudwatch/cloudwatchiface"
+)
+
+// PutMetricData API limits
+const (
+	maxDatumsPerRequest  = 1000
+	maxBytesPerRequest   = 1 << 20
+	maxValuesPerDatum    = 150
+	maxShutdownFlushTime = 10 * time.Second
+)
+
+// Sizes in the query protocol encoding of a PutMetricData body, where every
+// field of a datum is a key such as "MetricData.member.1000.Values.member.150=0.25&".
+// Member indexes are counted at their largest, so the sizes are upper bounds.
+const (
+	// requestOverheadBytes covers Action, Version and a Namespace of up to
+	// 255 characters, each of them escaped
+	requestOverheadBytes = len("Action=PutMetricData&Version=2010-08-01&Namespace=&") + 3*255
+	datumKeyBytes        = len("MetricData.member.1000.")
+	dimensionKeyBytes    = 2*(datumKeyBytes+len("Dimensions.member.30.")) + len("Name=&Value=&")
+	valueKeyBytes        = datumKeyBytes + len("Values.member.150=&")
+	countKeyBytes        = datumKeyBytes + len("Counts.member.150=&")
+	timestampBytes       = datumKeyBytes + len("Timestamp=2006-01-02T15%3A04%3A05.999999999Z&")
+	// maxCountBytes is the widest count, 2^53 written without an exponent
+	maxCountBytes = len("9007199254740992")
+)
+
+// metricBuffer collects datums into a bounded queue, aggregates them per
+// metric and dimension set, and publishes them to CloudWatch in batches.
+// A single background goroutine owns the aggregation state, so add is the
+// only method called from request handlers and it never blocks.
+type metricBuffer struct {
+	cw        cloudwatchiface.CloudWatchAPI
+	namespace string
+	logger    *slog.Logger
+	interval  time.Duration
+
+	queue   chan *cloudwatch.MetricDatum
+	dropped atomic.Int64
+
+	done      chan struct{}
+	stopped   chan struct{}
+	closeOnce sync.Once
+}
+
+// metricAggregate accumulates all datums sharing a name, unit and dimension set
+type metricAggregate struct {
+	name       string
+	unit       string
+	dimensions []*cloudwatch.Dimension
+
+	values   map[float64]float64
+	overflow bool
+	count    float64
+	sum      float64
+	min      float64
+	max      float64
+}
+
+// metricBatch is the set of aggregates pending the next flush
+type metricBatch struct {
+	aggregates map[string]*metricAggregate
+	bytes      int
+}
+
+func newMetricBuffer(cw cloudwatchiface.CloudWatchAPI, namespace string, interval time.Duration, queueSize int, logger *slog.Logger) *metricBuffer {
+	b := &metricBuffer{
+		cw:        cw,
+		namespace: namespace,
+		logger:    logger,
+		interval:  interval,
+		queue:     make(chan *cloudwatch.MetricDatum, queueSize),
+		done:      make(chan struct{}),
+		stopped:   make(chan struct{}),
+	}
+	go b.run()
+	return b
+}
+
+// add enqueues datums for the next flush, dropping them if the queue is full
+func (b *metricBuffer) add(datums ...*cloudwatch.MetricDatum) {
+	for _, datum := range datums {
+		select {
+		case b.queue <- datum:
+		default:
+			b.dropped.Add(1)
+		}
+	}
+}
+
+// Close stops the background goroutine after draining the queue and flushing
+// everything that is still pending
+func (b *metricBuffer) Close() {
+	b.closeOnce.Do(func() {
+		close(b.done)
+		select {
+		case <-b.stopped:
+		case <-time.After(maxShutdownFlushTime):
+			b.logger.Warn("Timed out flushing metrics on shutdown")
+		}
+	})
+}
+
+func (b *metricBuffer) run() {
+	defer close(b.stopped)
+
+	ticker := time.NewTicker(b.interval)
+	defer ticker.Stop()
+
+	batch := newMetricBatch()
+	for {
+		select {
+		case datum := <-b.queue:
+			batch.add(datum)
+			if batch.full() {
+				batch = b.flush(batch)
+			}
+		case <-ticker.C:
+			batch = b.flush(batch)
+		case <-b.done:
+			for {
+				select {
+				case datum := <-b.queue:
+					batch.add(datum)
+					if batch.full() {
+						batch = b.flush(batch)
+					}
+				default:
+					b.flush(batch)
+					return
+				}
+			}
+		}
+	}
+}
+
+// flush publishes the batch together with the pipeline's own metrics and
+// returns a fresh batch seeded with the latency of this flush
+func (b *metricBuffer) flush(batch *metricBatch) *metricBatch {
+	batch.add(pipelineDatum("MetricsPipeline_DroppedDatums", float64(b.dropped.Swap(0)), cloudwatch.StandardUnitCount))
+	batch.add(pipelineDatum("MetricsPipeline_QueueDepth", float64(len(b.queue)), cloudwatch.StandardUnitCount))
+
+	start := time.Now()
+	datums := batch.datums(start)
+	for len(datums) > 0 {
+		n := requestSize(datums)
+		_, err := b.cw.PutMetricData(&cloudwatch.PutMetricDataInput{
+			Namespace:  aws.String(b.namespace),
+			MetricData: datums[:n],
+		})
+		if err != nil {
+			// Counted in the MetricsPipeline_DroppedDatums of the next flush
+			b.dropped.Add(int64(n))
+			b.logger.Error("Failed to send CloudWatch metrics", "error", err, "datums", n)
+		}
+		datums = datums[n:]
+	}
+
+	next := newMetricBatch()
+	next.add(pipelineDatum("MetricsPipeline_FlushDuration", time.Since(start).Seconds(), cloudwatch.StandardUnitSeconds))
+	return next
+}
+
+// requestSize returns how many of the leading datums fit in one PutMetricData call
+func requestSize(datums []*cloudwatch.MetricDatum) int {
+	bytes := requestOverheadBytes
+	for i, datum := range datums {
+		bytes += datumSize(datum)
+		if i == maxDatumsPerRequest || (i > 0 && bytes > maxBytesPerRequest) {
+			return i
+		}
+	}
+	return len(datums)
+}
+
+func pipelineDatum(name string, value float64, unit string) *cloudwatch.MetricDatum {
+	return &cloudwatch.MetricDatum{
+		MetricName: aws.String(name),
+		Value:      aws.Float64(value),
+		Unit:       aws.String(unit),
+		Dimensions: []*cloudwatch.Dimension{},
+	}
+}
+
+func newMetricBatch() *metricBatch {
+	return &metricBatch{aggregates: make(map[string]*metricAggregate)}
+}
+
+func (mb *metricBatch) add(datum *cloudwatch.MetricDatum) {
+	key := aggregateKey(datum)
+	agg, ok := mb.aggregates[key]
+	if !ok {
+		agg = &metricAggregate{
+			name:       aws.StringValue(datum.MetricName),
+			unit:       aws.StringValue(datum.Unit),
+			dimensions: datum.Dimensions,
+			values:     make(map[float64]float64),
+		}
+		mb.aggregates[key] = agg
+		mb.bytes += datumHeaderSize(datum)
+	}
+
+	// Counts are budgeted at their widest, as they grow after the value is sized
+	value := aws.Float64Value(datum.Value)
+	if _, seen := agg.values[value]; !seen && len(agg.values) < maxValuesPerDatum {
+		mb.bytes += valueKeyBytes + len(formatQueryFloat(value)) + countKeyBytes + maxCountBytes
+	}
+	agg.observe(value)
+}
+
+// full reports whether the batch has reached the PutMetricData limits
+func (mb *metricBatch) full() bool {
+	return len(mb.aggregates) >= maxDatumsPerRequest || requestOverheadBytes+mb.bytes >= maxBytesPerRequest
+}
+
+func (mb *metricBatch) datums(timestamp time.Time) []*cloudwatch.MetricDatum {
+	datums := make([]*cloudwatch.MetricDatum, 0, len(mb.aggregates))
+	for _, agg := range mb.aggregates {
+		datums = append(datums, agg.datum(timestamp))
+	}
+	return datums
+}
+
+func (agg *metricAggregate) observe(value float64) {
+	if agg.count == 0 || value < agg.min {
+		agg.min = value
+	}
+	if agg.count == 0 || value > agg.max {
+		agg.max = value
+	}
+	agg.count++
+	agg.sum += value
+
+	if _, seen := agg.values[value]; seen || len(agg.values) < maxValuesPerDatum {
+		agg.values[value]++
+	} else {
+		agg.overflow = true
+	}
+}
+
+// datum renders the aggregate as Values/Counts when the distinct values fit in
+// a single datum, and as StatisticValues otherwise
+func (agg *metricAggregate) datum(timestamp time.Time) *cloudwatch.MetricDatum {
+	datum := &cloudwatch.MetricDatum{
+		MetricName: aws.String(agg.name),
+		Unit:       aws.String(agg.unit),
+		Dimensions: agg.dimensions,
+		Timestamp:  aws.Time(timestamp),
+	}
+
+	if agg.overflow {
+		datum.StatisticValues = &cloudwatch.StatisticSet{
+			SampleCount: aws.Float64(agg.count),
+			Sum:         aws.Float64(agg.sum),
+			Minimum:     aws.Float64(agg.min),
+			Maximum:     aws.Float64(agg.max),
+		}
+		return datum
+	}
+
+	for value, count := range agg.values {
+		datum.Values = append(datum.Values, aws.Float64(value))
+		datum.Counts = append(datum.Counts, aws.Float64(count))
+	}
+	return datum
+}
+
+// aggregateKey identifies a metric by name, unit and sorted dimensions. Every
+// part is length-prefixed, so dimension values containing separators such as
+// "=" or "," cannot make two different dimension sets share a key.
+func aggregateKey(datum *cloudwatch.MetricDatum) string {
+	dims := make([]string, 0, len(datum.Dimensions))
+	for _, dim := range datum.Dimensions {
+		dims = append(dims, lengthPrefixed(aws.StringValue(dim.Name))+lengthPrefixed(aws.StringValue(dim.Value)))
+	}
+	sort.Strings(dims)
+	return lengthPrefixed(aws.StringValue(datum.MetricName)) + lengthPrefixed(aws.StringValue(datum.Unit)) + strings.Join(dims, "")
+}
+
+// lengthPrefixed returns s preceded by its length, e.g. "5:Count"
+func lengthPrefixed(s string) string {
+	return strconv.Itoa(len(s)) + ":" + s
+}
+
+// datumSize returns an upper bound of the encoded size of a datum in a
+// PutMetricData request
+func datumSize(datum *cloudwatch.MetricDatum) int {
+	size := datumHeaderSize(datum)
+	for _, value := range datum.Values {
+		size += valueKeyBytes + len(formatQueryFloat(aws.Float64Value(value)))
+	}
+	for _, count := range datum.Counts {
+		size += countKeyBytes + len(formatQueryFloat(aws.Float64Value(count)))
+	}
+	if stats := datum.StatisticValues; stats != nil {
+		size += 4*datumKeyBytes + len("StatisticValues.SampleCount=&StatisticValues.Sum=&StatisticValues.Minimum=&StatisticValues.Maximum=&") +
+			len(formatQueryFloat(aws.Float64Value(stats.SampleCount))) + len(formatQueryFloat(aws.Float64Value(stats.Sum))) +
+			len(formatQueryFloat(aws.Float64Value(stats.Minimum))) + len(formatQueryFloat(aws.Float64Value(stats.Maximum)))
+	}
+	return size
+}
+
+// datumHeaderSize returns an upper bound of the encoded size of the name,
+// unit, timestamp and dimensions of a datum
+func datumHeaderSize(datum *cloudwatch.MetricDatum) int {
+	size := 2*datumKeyBytes + len("MetricName=&Unit=&") + timestampBytes +
+		len(url.QueryEscape(aws.StringValue(datum.MetricName))) + len(url.QueryEscape(aws.StringValue(datum.Unit)))
+	for _, dim := range datum.Dimensions {
+		size += dimensionKeyBytes + len(url.QueryEscape(aws.StringValue(dim.Name))) + len(url.QueryEscape(aws.StringValue(dim.Value)))
+	}
+	return size
+}
+
+// formatQueryFloat formats a float the way the query protocol encodes it:
+// without an exponent, so very large and very small values are long
+func formatQueryFloat(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/private/protocol/query/queryutil"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/cloudwatch/cloudwatchiface"
+)
+
+func TestAggregateKeyDistinguishesDimensionSets(t *testing.T) {
+	datum := func(dims ...string) *cloudwatch.MetricDatum {
+		datum := &cloudwatch.MetricDatum{MetricName: aws.String("RequestCount"), Unit: aws.String("Count")}
+		for i := 0; i < len(dims); i += 2 {
+			datum.Dimensions = append(datum.Dimensions, &cloudwatch.Dimension{Name: aws.String(dims[i]), Value: aws.String(dims[i+1])})
+		}
+		return datum
+	}
+
+	pairs := [][2]*cloudwatch.MetricDatum{
+		// Values containing the separators of a plain "name=value,name=value" key
+		{datum("A", "x,B=y"), datum("A", "x", "B", "y")},
+		{datum("A=x", ""), datum("A", "x=")},
+		{datum("A", "x", "B", ""), datum("A", "x,B=")},
+	}
+	for _, pair := range pairs {
+		if aggregateKey(pair[0]) == aggregateKey(pair[1]) {
+			t.Errorf("dimension sets %v and %v share the key %q", pair[0].Dimensions, pair[1].Dimensions, aggregateKey(pair[0]))
+		}
+	}
+
+	// The same dimensions in any order are the same metric
+	if aggregateKey(datum("A", "x", "B", "y")) != aggregateKey(datum("B", "y", "A", "x")) {
+		t.Error("dimension order changed the key")
+	}
+}
+
+func TestCloudWatchMetricsDropsEmptyDimensions(t *testing.T) {
+	buffer := &metricBuffer{queue: make(chan *cloudwatch.MetricDatum, 10)}
+	metrics := &CloudWatchMetrics{buffer: buffer}
+
+	metrics.Counter(context.Background(), "RequestCount_ByEndpoint", 1, Dimension{Name: "Endpoint", Value: ""})
+	metrics.Counter(context.Background(), "RequestCount_ByEndpoint", 1, Dimension{Name: "Endpoint", Value: "/coffee"})
+
+	if got := len(buffer.queue); got != 1 {
+		t.Errorf("queued %d datums, want 1", got)
+	}
+	if got := buffer.dropped.Load(); got != 1 {
+		t.Errorf("dropped %d datums, want 1", got)
+	}
+}
+
+func TestFullBatchFitsInPutMetricDataRequests(t *testing.T) {
+	batch := newMetricBatch()
+	for i := 0; !batch.full(); i++ {
+		batch.add(&cloudwatch.MetricDatum{
+			MetricName: aws.String("RequestDuration_ByStatusClass"),
+			Unit:       aws.String(cloudwatch.StandardUnitSeconds),
+			// Every value is seen twice, so each datum carries full Values and Counts
+			Value: aws.Float64(float64(i%maxValuesPerDatum) / 7),
+			Dimensions: []*cloudwatch.Dimension{
+				{Name: aws.String("Endpoint"), Value: aws.String("/coffee/{id}/cancel-" + strconv.Itoa(i/(2*maxValuesPerDatum)))},
+				{Name: aws.String("Method"), Value: aws.String(http.MethodPost)},
+				{Name: aws.String("StatusClass"), Value: aws.String("2xx")},
+			},
+		})
+	}
+
+	datums := batch.datums(time.Now())
+	for requests := 0; len(datums) > 0; requests++ {
+		n := requestSize(datums)
+		body := url.Values{"Action": {"PutMetricData"}, "Version": {"2010-08-01"}}
+		input := &cloudwatch.PutMetricDataInput{Namespace: aws.String(MetricsNamespace), MetricData: datums[:n]}
+		if err := queryutil.Parse(body, input, false); err != nil {
+			t.Fatal(err)
+		}
+
+		encoded := len(body.Encode())
+		if encoded > maxBytesPerRequest {
+			t.Errorf("request %d of %d datums is %d bytes, over the %d byte limit", requests, n, encoded, maxBytesPerRequest)
+		}
+		// The estimate is an upper bound, but not a wasteful one
+		if requests == 0 && encoded < maxBytesPerRequest*3/4 {
+			t.Errorf("first request is %d bytes, want close to the %d byte limit", encoded, maxBytesPerRequest)
+		}
+		datums = datums[n:]
+	}
+}
+
+// fakeCloudWatch records PutMetricData calls, failing the first failures of them
+type fakeCloudWatch struct {
+	cloudwatchiface.CloudWatchAPI
+
+	mu       sync.Mutex
+	inputs   []*cloudwatch.PutMetricDataInput
+	failures int
+}
+
+func (f *fakeCloudWatch) PutMetricData(input *cloudwatch.PutMetricDataInput) (*cloudwatch.PutMetricDataOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.failures > 0 {
+		f.failures--
+		return nil, errors.New("throttled")
+	}
+	f.inputs = append(f.inputs, input)
+	return &cloudwatch.PutMetricDataOutput{}, nil
+}
+
+// requests returns the successful PutMetricData calls
+func (f *fakeCloudWatch) requests() []*cloudwatch.PutMetricDataInput {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]*cloudwatch.PutMetricDataInput(nil), f.inputs...)
+}
+
+// datums returns the published datums named name
+func (f *fakeCloudWatch) datums(name string) []*cloudwatch.MetricDatum {
+	var datums []*cloudwatch.MetricDatum
+	for _, input := range f.requests() {
+		for _, datum := range input.MetricData {
+			if aws.StringValue(datum.MetricName) == name {
+				datums = append(datums, datum)
+			}
+		}
+	}
+	return datums
+}
+
+func newTestMetricBuffer(cw cloudwatchiface.CloudWatchAPI, interval time.Duration, queueSize int) *metricBuffer {
+	return newMetricBuffer(cw, MetricsNamespace, interval, queueSize, slog.New(slog.NewTextHandler(io.Discard, nil)))
+}
+
+func countDatum(name string, value float64, dims ...string) *cloudwatch.MetricDatum {
+	datum := &cloudwatch.MetricDatum{MetricName: aws.String(name), Value: aws.Float64(value), Unit: aws.String(cloudwatch.StandardUnitCount)}
+	for i := 0; i < len(dims); i += 2 {
+		datum.Dimensions = append(datum.Dimensions, &cloudwatch.Dimension{Name: aws.String(dims[i]), Value: aws.String(dims[i+1])})
+	}
+	return datum
+}
+
+func TestMetricBufferFlushesOnInterval(t *testing.T) {
+	cw := &fakeCloudWatch{}
+	buffer := newTestMetricBuffer(cw, 10*time.Millisecond, 100)
+	defer buffer.Close()
+
+	buffer.add(countDatum("RequestCount", 1))
+
+	deadline := time.Now().Add(2 * time.Second)
+	for len(cw.datums("RequestCount")) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("RequestCount was not published on the flush interval")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestMetricBufferFlushesOnClose(t *testing.T) {
+	cw := &fakeCloudWatch{}
+	buffer := newTestMetricBuffer(cw, time.Hour, 100)
+
+	for i := 0; i < 3; i++ {
+		buffer.add(countDatum("RequestCount", 1))
+	}
+	buffer.Close()
+
+	datums := cw.datums("RequestCount")
+	if len(datums) != 1 {
+		t.Fatalf("published %d RequestCount datums, want the 3 observations aggregated into 1", len(datums))
+	}
+	if values, counts := aws.Float64ValueSlice(datums[0].Values), aws.Float64ValueSlice(datums[0].Counts); len(values) != 1 || values[0] != 1 || counts[0] != 3 {
+		t.Errorf("RequestCount Values = %v, Counts = %v; want [1], [3]", values, counts)
+	}
+	if got := aws.StringValue(cw.requests()[0].Namespace); got != MetricsNamespace {
+		t.Errorf("namespace = %s, want %s", got, MetricsNamespace)
+	}
+}
+
+func TestMetricBufferSplitsRequestsByCount(t *testing.T) {
+	cw := &fakeCloudWatch{}
+	buffer := newTestMetricBuffer(cw, time.Hour, 3000)
+
+	for i := 0; i < 2500; i++ {
+		buffer.add(countDatum("RequestCount_ByEndpoint", 1, "Endpoint", "/coffee/"+strconv.Itoa(i)))
+	}
+	buffer.Close()
+
+	for _, input := range cw.requests() {
+		if len(input.MetricData) > maxDatumsPerRequest {
+			t.Errorf("request has %d datums, over the limit of %d", len(input.MetricData), maxDatumsPerRequest)
+		}
+	}
+	if got := len(cw.datums("RequestCount_ByEndpoint")); got != 2500 {
+		t.Errorf("published %d RequestCount_ByEndpoint datums, want 2500", got)
+	}
+}
+
+func TestRequestSizeSplitsByBytes(t *testing.T) {
+	datums := make([]*cloudwatch.MetricDatum, 200)
+	for i := range datums {
+		datums[i] = &cloudwatch.MetricDatum{MetricName: aws.String("RequestDuration"), Unit: aws.String(cloudwatch.StandardUnitSeconds)}
+		for v := 0; v < maxValuesPerDatum; v++ {
+			datums[i].Values = append(datums[i].Values, aws.Float64(float64(v)/7))
+			datums[i].Counts = append(datums[i].Counts, aws.Float64(1))
+		}
+	}
+
+	n := requestSize(datums)
+	if n == 0 || n == len(datums) {
+		t.Fatalf("requestSize = %d, want the %d datums split into several requests", n, len(datums))
+	}
+	size := requestOverheadBytes
+	for _, datum := range datums[:n] {
+		size += datumSize(datum)
+	}
+	if size > maxBytesPerRequest || size+datumSize(datums[n]) <= maxBytesPerRequest {
+		t.Errorf("first request is %d bytes, want the most datums that fit in %d bytes", size, maxBytesPerRequest)
+	}
+}
+
+func TestMetricAggregateOverflowsToStatisticValues(t *testing.T) {
+	batch := newMetricBatch()
+	for v := 0; v < maxValuesPerDatum; v++ {
+		batch.add(countDatum("Fits", float64(v)))
+		batch.add(countDatum("Overflows", float64(v)))
+	}
+	batch.add(countDatum("Overflows", maxValuesPerDatum))
+
+	for _, datum := range batch.datums(time.Now()) {
+		switch aws.StringValue(datum.MetricName) {
+		case "Fits":
+			if len(datum.Values) != maxValuesPerDatum || len(datum.Counts) != maxValuesPerDatum || datum.StatisticValues != nil {
+				t.Errorf("Fits has %d values, %d counts and statistics %v; want %d values and counts", len(datum.Values), len(datum.Counts), datum.StatisticValues, maxValuesPerDatum)
+			}
+		case "Overflows":
+			stats := datum.StatisticValues
+			if stats == nil || len(datum.Values) != 0 {
+				t.Fatalf("Overflows has %d values and statistics %v, want statistics only", len(datum.Values), stats)
+			}
+			if *stats.SampleCount != maxValuesPerDatum+1 || *stats.Sum != maxValuesPerDatum*(maxValuesPerDatum+1)/2 || *stats.Minimum != 0 || *stats.Maximum != maxValuesPerDatum {
+				t.Errorf("Overflows statistics = %v", stats)
+			}
+		}
+	}
+}
+
+func TestMetricBufferCountsDroppedDatums(t *testing.T) {
+	cw := &fakeCloudWatch{failures: 1}
+	// Without the background goroutine, the queue fills up
+	buffer := &metricBuffer{
+		cw:        cw,
+		namespace: MetricsNamespace,
+		logger:    slog.New(slog.NewTextHandler(io.Discard, nil)),
+		queue:     make(chan *cloudwatch.MetricDatum, 1),
+	}
+	for i := 0; i < 3; i++ {
+		buffer.add(countDatum("RequestCount", 1))
+	}
+
+	batch := newMetricBatch()
+	batch.add(<-buffer.queue)
+	// The first call fails, losing RequestCount and the two pipeline datums
+	batch = buffer.flush(batch)
+	buffer.flush(batch)
+
+	dropped := cw.datums("MetricsPipeline_DroppedDatums")
+	if len(dropped) != 1 {
+		t.Fatalf("published %d MetricsPipeline_DroppedDatums datums, want 1", len(dropped))
+	}
+	if got := aws.Float64Value(dropped[0].Values[0]); got != 3 {
+		t.Errorf("MetricsPipeline_DroppedDatums = %g, want the 3 datums of the failed call", got)
+	}
+	if got := buffer.dropped.Load(); got != 0 {
+		t.Errorf("%d dropped datums not yet published, want 0", got)
+	}
+}
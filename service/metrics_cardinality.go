@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OtherDimensionValue replaces dimension values that exceed the cardinality limit
+const OtherDimensionValue = "__other__"
+
+// trackedValuesPerSlot is how many values the frequency counts of a dimension
+// keep per admitted value. Tracking more values than are admitted keeps the
+// estimated ranking accurate when many values are close in frequency.
+const trackedValuesPerSlot = 4
+
+// CardinalityLimiter bounds the number of distinct values a dimension can take,
+// so client-supplied values cannot create an unlimited number of metrics.
+// A dimension is either guarded by an allowlist, or admits at most N values
+// per window: the N most frequent values of the previous window, and new
+// values while fewer than N are admitted. Values outside the allowlist or the
+// admitted set are collapsed into OtherDimensionValue. Dimensions without a
+// rule are passed through unchanged.
+type CardinalityLimiter struct {
+	recorder MetricsRecorder
+	logger   *slog.Logger
+	window   time.Duration
+	now      func() time.Time
+
+	mu          sync.Mutex
+	allowlists  map[string]map[string]bool
+	limits      map[string]int
+	top         map[string]*topValues
+	windowStart time.Time
+	overflowed  map[string]bool
+}
+
+// topValues are the admitted values of a dimension and the value frequencies
+// counted in the current window
+type topValues struct {
+	admitted map[string]bool
+	counts   *spaceSaving
+}
+
+// NewCardinalityLimiter creates a limiter with per-dimension value limits and
+// allowlists. An allowlist takes precedence over a limit for the same dimension.
+// The values admitted under a limit are re-ranked by frequency every window.
+// Collapsed values are counted through recorder.
+func NewCardinalityLimiter(limits map[string]int, allowlists map[string][]string, window time.Duration, recorder MetricsRecorder, logger *slog.Logger) *CardinalityLimiter {
+	l := &CardinalityLimiter{
+		recorder:    recorder,
+		logger:      logger,
+		window:      window,
+		now:         time.Now,
+		allowlists:  make(map[string]map[string]bool),
+		limits:      limits,
+		top:         make(map[string]*topValues),
+		windowStart: time.Now(),
+		overflowed:  make(map[string]bool),
+	}
+	for name, values := range allowlists {
+		allowed := make(map[string]bool, len(values))
+		for _, value := range values {
+			allowed[value] = true
+		}
+		l.allowlists[name] = allowed
+	}
+	return l
+}
+
+// Dimension returns the dimension name=value, with value collapsed into
+// OtherDimensionValue if it exceeds the dimension's cardinality rule
+func (l *CardinalityLimiter) Dimension(ctx context.Context, name string, value string) Dimension {
+	if l.admit(ctx, name, value) {
+		return Dimension{Name: name, Value: value}
+	}
+
+	l.recorder.Counter(ctx, "MetricsCardinality_CollapsedValues", 1, Dimension{Name: "Dimension", Value: name})
+	return Dimension{Name: name, Value: OtherDimensionValue}
+}
+
+// admit counts value and reports whether it may be used as is, logging a
+// warning the first time name overflows in a window
+func (l *CardinalityLimiter) admit(ctx context.Context, name string, value string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if allowed, ok := l.allowlists[name]; ok {
+		if allowed[value] {
+			return true
+		}
+		l.warnOverflow(ctx, name, "value not in allowlist")
+		return false
+	}
+
+	limit, ok := l.limits[name]
+	if !ok {
+		return true
+	}
+
+	if now := l.now(); now.Sub(l.windowStart) >= l.window {
+		l.rotate(now)
+	}
+
+	top, ok := l.top[name]
+	if !ok {
+		top = &topValues{admitted: make(map[string]bool), counts: newSpaceSaving(limit * trackedValuesPerSlot)}
+		l.top[name] = top
+	}
+	top.counts.observe(value)
+
+	if top.admitted[value] {
+		return true
+	}
+	if len(top.admitted) < limit {
+		top.admitted[value] = true
+		return true
+	}
+	l.warnOverflow(ctx, name, "distinct value limit reached")
+	return false
+}
+
+// rotate starts a new window in which each dimension admits the most frequent
+// values of the window that ended. The caller must hold l.mu.
+func (l *CardinalityLimiter) rotate(now time.Time) {
+	for name, top := range l.top {
+		limit := l.limits[name]
+		admitted := make(map[string]bool, limit)
+		for _, value := range top.counts.top(limit) {
+			admitted[value] = true
+		}
+		l.top[name] = &topValues{admitted: admitted, counts: newSpaceSaving(limit * trackedValuesPerSlot)}
+	}
+	l.windowStart = now
+	l.overflowed = make(map[string]bool)
+}
+
+// warnOverflow logs once per dimension and window. The caller must hold l.mu.
+func (l *CardinalityLimiter) warnOverflow(ctx context.Context, name string, reason string) {
+	if l.overflowed[name] {
+		return
+	}
+	l.overflowed[name] = true
+
+	l.logger.WarnContext(ctx, "Metric dimension overflowed, collapsing new values",
+		"dimension", name,
+		"reason", reason,
+		"collapsed_value", OtherDimensionValue,
+	)
+}
+
+// spaceSaving estimates the most frequent values of a stream in bounded memory
+// with the Space-Saving algorithm. It counts at most capacity values; an
+// unseen value replaces the least counted one and takes over its count, which
+// overestimates the new value by at most that count.
+type spaceSaving struct {
+	capacity int
+	counts   map[string]int
+}
+
+func newSpaceSaving(capacity int) *spaceSaving {
+	return &spaceSaving{capacity: capacity, counts: make(map[string]int, capacity)}
+}
+
+// observe counts one occurrence of value
+func (s *spaceSaving) observe(value string) {
+	if _, ok := s.counts[value]; ok || len(s.counts) < s.capacity {
+		s.counts[value]++
+		return
+	}
+
+	var minValue string
+	minCount := -1
+	for v, count := range s.counts {
+		if minCount < 0 || count < minCount || (count == minCount && v < minValue) {
+			minValue, minCount = v, count
+		}
+	}
+	delete(s.counts, minValue)
+	s.counts[value] = minCount + 1
+}
+
+// top returns up to n values, most frequent first
+func (s *spaceSaving) top(n int) []string {
+	values := make([]string, 0, len(s.counts))
+	for value := range s.counts {
+		values = append(values, value)
+	}
+	sort.Slice(values, func(i, j int) bool {
+		if s.counts[values[i]] != s.counts[values[j]] {
+			return s.counts[values[i]] > s.counts[values[j]]
+		}
+		return values[i] < values[j]
+	})
+	if len(values) > n {
+		values = values[:n]
+	}
+	return values
+}
+
+// parseDimensionLimits parses "UserName=50,CoffeeType=20" into a map of limits
+func parseDimensionLimits(spec string) map[string]int {
+	limits := make(map[string]int)
+	for name, value := range parseDimensionSpec(spec) {
+		if n, err := strconv.Atoi(value); err == nil {
+			limits[name] = n
+		}
+	}
+	return limits
+}
+
+// parseDimensionAllowlists parses "CoffeeType=espresso|latte,UserName=Tom" into a map of allowlists
+func parseDimensionAllowlists(spec string) map[string][]string {
+	allowlists := make(map[string][]string)
+	for name, value := range parseDimensionSpec(spec) {
+		allowlists[name] = strings.Split(value, "|")
+	}
+	return allowlists
+}
+
+func parseDimensionSpec(spec string) map[string]string {
+	entries := make(map[string]string)
+	for _, entry := range strings.Split(spec, ",") {
+		name, value, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if ok && name != "" {
+			entries[name] = value
+		}
+	}
+	return entries
+}
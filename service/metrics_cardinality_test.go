@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+)
+
+func TestCardinalityLimiterAdmitsMostFrequentValues(t *testing.T) {
+	recorder := NewMemoryMetrics()
+	limiter := NewCardinalityLimiter(map[string]int{"CoffeeType": 2}, nil, time.Hour, recorder, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	now := time.Now()
+	limiter.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	admitted := func(value string) bool {
+		return limiter.Dimension(ctx, "CoffeeType", value).Value == value
+	}
+
+	// The first window admits values first come first served
+	for _, value := range []string{"ristretto", "lungo"} {
+		if !admitted(value) {
+			t.Fatalf("%s was collapsed while slots were free", value)
+		}
+	}
+	for i := 0; i < 10; i++ {
+		if admitted("latte") {
+			t.Fatal("latte was admitted beyond the limit")
+		}
+		admitted("espresso")
+	}
+	if got := recorder.Sum("MetricsCardinality_CollapsedValues", Dimension{Name: "Dimension", Value: "CoffeeType"}); got != 20 {
+		t.Errorf("MetricsCardinality_CollapsedValues = %g, want 20", got)
+	}
+
+	// The next window admits the most frequent values of the previous one
+	now = now.Add(time.Hour)
+	for _, value := range []string{"latte", "espresso"} {
+		if !admitted(value) {
+			t.Errorf("frequent value %s was collapsed after the window rotated", value)
+		}
+	}
+	for _, value := range []string{"ristretto", "lungo"} {
+		if admitted(value) {
+			t.Errorf("rare value %s was still admitted after the window rotated", value)
+		}
+	}
+}
+
+func TestSpaceSavingKeepsFrequentValuesWithinCapacity(t *testing.T) {
+	counts := newSpaceSaving(3)
+	for i := 0; i < 100; i++ {
+		counts.observe("frequent")
+		// A stream of distinct values competes for the other slots
+		counts.observe(time.Duration(i).String())
+	}
+
+	if len(counts.counts) > 3 {
+		t.Errorf("tracked %d values, want at most 3", len(counts.counts))
+	}
+	if top := counts.top(1); len(top) != 1 || top[0] != "frequent" {
+		t.Errorf("top(1) = %v, want [frequent]", top)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/cloudwatch/cloudwatchiface"
+)
+
+// CloudWatchMetrics is a MetricsRecorder that publishes to CloudWatch through a metricBuffer
+type CloudWatchMetrics struct {
+	buffer *metricBuffer
+}
+
+// NewCloudWatchMetrics creates a CloudWatchMetrics that batches datums in memory
+// and publishes them every flushInterval
+func NewCloudWatchMetrics(cw cloudwatchiface.CloudWatchAPI, flushInterval time.Duration, queueSize int, logger *slog.Logger) *CloudWatchMetrics {
+	return &CloudWatchMetrics{
+		buffer: newMetricBuffer(cw, MetricsNamespace, flushInterval, queueSize, logger),
+	}
+}
+
+// Counter queues a Count datum for the next flush
+func (m *CloudWatchMetrics) Counter(ctx context.Context, name string, value float64, dims ...Dimension) {
+	m.record(name, value, UnitCount, dims)
+}
+
+// Histogram queues a datum for the next flush; the buffer aggregates
+// observations into Values/Counts or StatisticValues
+func (m *CloudWatchMetrics) Histogram(ctx context.Context, name string, value float64, unit Unit, dims ...Dimension) {
+	m.record(name, value, unit, dims)
+}
+
+// Gauge queues a datum for the next flush
+func (m *CloudWatchMetrics) Gauge(ctx context.Context, name string, value float64, unit Unit, dims ...Dimension) {
+	m.record(name, value, unit, dims)
+}
+
+// Ping checks that the CloudWatch API is reachable and the credentials are valid
+func (m *CloudWatchMetrics) Ping(ctx context.Context) error {
+	_, err := m.buffer.cw.ListMetricsWithContext(ctx, &cloudwatch.ListMetricsInput{
+		Namespace: aws.String(m.buffer.namespace),
+	})
+	return err
+}
+
+// Close flushes all buffered metrics to CloudWatch
+func (m *CloudWatchMetrics) Close() {
+	m.buffer.Close()
+}
+
+// record queues a datum. A datum with an empty dimension name or value is
+// dropped and counted, as CloudWatch would reject the whole PutMetricData call
+// that carried it.
+func (m *CloudWatchMetrics) record(name string, value float64, unit Unit, dims []Dimension) {
+	dimensions := make([]*cloudwatch.Dimension, 0, len(dims))
+	for _, dim := range dims {
+		if dim.Name == "" || dim.Value == "" {
+			m.buffer.dropped.Add(1)
+			return
+		}
+		dimensions = append(dimensions, &cloudwatch.Dimension{
+			Name:  aws.String(dim.Name),
+			Value: aws.String(dim.Value),
+		})
+	}
+
+	m.buffer.add(&cloudwatch.MetricDatum{
+		MetricName: aws.String(name),
+		Value:      aws.Float64(value),
+		Unit:       aws.String(string(unit)),
+		Dimensions: dimensions,
+	})
+}
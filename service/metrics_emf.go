@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// emfMessage is the log message of every EMF record, so they are easy to filter out of the log stream
+const emfMessage = "metric"
+
+// EMFMetrics is a MetricsRecorder that writes every value as a CloudWatch
+// Embedded Metric Format document through the JSON slog handler. The awslogs
+// driver ships the documents to CloudWatch Logs, which extracts the metrics
+// without any PutMetricData calls.
+type EMFMetrics struct {
+	namespace string
+	logger    *slog.Logger
+}
+
+// emfMetadata is the "_aws" member that tells CloudWatch how to extract the metric
+type emfMetadata struct {
+	Timestamp         int64                `json:"Timestamp"`
+	CloudWatchMetrics []emfMetricDirective `json:"CloudWatchMetrics"`
+}
+
+type emfMetricDirective struct {
+	Namespace  string          `json:"Namespace"`
+	Dimensions [][]string      `json:"Dimensions"`
+	Metrics    []emfMetricInfo `json:"Metrics"`
+}
+
+type emfMetricInfo struct {
+	Name string `json:"Name"`
+	Unit Unit   `json:"Unit"`
+}
+
+// NewEMFMetrics creates an EMFMetrics that logs to logger, which must use a JSON
+// handler wrapped by NewContextHandler
+func NewEMFMetrics(namespace string, logger *slog.Logger) *EMFMetrics {
+	return &EMFMetrics{
+		namespace: namespace,
+		logger:    logger,
+	}
+}
+
+// Counter writes a Count metric
+func (m *EMFMetrics) Counter(ctx context.Context, name string, value float64, dims ...Dimension) {
+	m.emit(ctx, name, value, UnitCount, dims)
+}
+
+// Histogram writes a single observation; CloudWatch aggregates the statistics
+func (m *EMFMetrics) Histogram(ctx context.Context, name string, value float64, unit Unit, dims ...Dimension) {
+	m.emit(ctx, name, value, unit, dims)
+}
+
+// Gauge writes the current value
+func (m *EMFMetrics) Gauge(ctx context.Context, name string, value float64, unit Unit, dims ...Dimension) {
+	m.emit(ctx, name, value, unit, dims)
+}
+
+// Close is a no-op; every record is written synchronously
+func (m *EMFMetrics) Close() {}
+
+// emit logs one EMF document. Dimension values and the metric value are
+// top-level members; request_id and trace_id are plain properties, so they are
+// searchable in CloudWatch Logs Insights without becoming dimensions.
+func (m *EMFMetrics) emit(ctx context.Context, name string, value float64, unit Unit, dims []Dimension) {
+	dimensionNames := make([]string, 0, len(dims))
+	attrs := make([]slog.Attr, 0, len(dims)+2)
+	for _, dim := range dims {
+		dimensionNames = append(dimensionNames, dim.Name)
+		attrs = append(attrs, slog.String(dim.Name, dim.Value))
+	}
+
+	attrs = append(attrs,
+		slog.Any("_aws", emfMetadata{
+			Timestamp: time.Now().UnixMilli(),
+			CloudWatchMetrics: []emfMetricDirective{{
+				Namespace:  m.namespace,
+				Dimensions: [][]string{dimensionNames},
+				Metrics:    []emfMetricInfo{{Name: name, Unit: unit}},
+			}},
+		}),
+		slog.Float64(name, value),
+	)
+
+	// The record goes straight to the handler so a raised log level never drops
+	// metrics. The context handler adds request_id and trace_id from ctx.
+	record := slog.NewRecord(time.Now(), slog.LevelInfo, emfMessage, 0)
+	record.AddAttrs(attrs...)
+	m.logger.Handler().Handle(ctx, record)
+}
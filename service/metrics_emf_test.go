@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"testing"
+	"time"
+
+	metricnoop "go.opentelemetry.io/otel/metric/noop"
+	tracenoop "go.opentelemetry.io/otel/trace/noop"
+)
+
+func TestEMFUserNameMatchesLogToken(t *testing.T) {
+	redactor, err := NewRedactor(RedactHash, "test-salt", []string{"user_name"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	logs := &syncBuffer{}
+	logger := slog.New(NewContextHandler(slog.NewJSONHandler(logs, nil), slog.LevelInfo, redactor, false))
+
+	recorder := NewEMFMetrics("test", logger)
+	limiter := NewCardinalityLimiter(nil, nil, time.Hour, recorder, logger)
+	metrics, err := NewMetrics(recorder, limiter, redactor, metricnoop.NewMeterProvider().Meter("test"), tracenoop.NewTracerProvider().Tracer("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	metrics.sendCreatedCoffeeOrderMetrics(context.Background(), "latte", "alice")
+	logger.Info("Coffee order created", "user_name", "alice")
+
+	want, _ := redactor.Redact("alice")
+	var logged, emitted bool
+	for _, line := range logs.lines(t) {
+		if _, ok := line["CreatedCoffeeOrders_ByName"]; ok {
+			emitted = true
+			if line["UserName"] != want {
+				t.Errorf("EMF UserName = %v, want %s", line["UserName"], want)
+			}
+		}
+		if line["msg"] == "Coffee order created" {
+			logged = true
+			if line["user_name"] != want {
+				t.Errorf("log user_name = %v, want %s", line["user_name"], want)
+			}
+		}
+	}
+	if !logged || !emitted {
+		t.Fatalf("logged = %v, emitted = %v: %s", logged, emitted, logs.Bytes())
+	}
+}
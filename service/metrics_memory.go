@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// MetricKind is the type of instrument a sample was recorded with
+type MetricKind string
+
+const (
+	KindCounter   MetricKind = "counter"
+	KindHistogram MetricKind = "histogram"
+	KindGauge     MetricKind = "gauge"
+)
+
+// MetricSample is a single value recorded by MemoryMetrics
+type MetricSample struct {
+	Kind       MetricKind
+	Name       string
+	Value      float64
+	Unit       Unit
+	Dimensions []Dimension
+	// RequestID and TraceID identify the request and trace the sample was
+	// recorded in, like the properties of an EMF document
+	RequestID string
+	TraceID   string
+}
+
+// MemoryMetrics is a MetricsRecorder that keeps every sample in memory.
+// It is meant for local runs and tests that assert on recorded metrics.
+type MemoryMetrics struct {
+	mu      sync.Mutex
+	samples []MetricSample
+}
+
+// NewMemoryMetrics creates an empty MemoryMetrics
+func NewMemoryMetrics() *MemoryMetrics {
+	return &MemoryMetrics{}
+}
+
+// Counter records a counter sample
+func (m *MemoryMetrics) Counter(ctx context.Context, name string, value float64, dims ...Dimension) {
+	m.record(ctx, KindCounter, name, value, UnitCount, dims)
+}
+
+// Histogram records a histogram sample
+func (m *MemoryMetrics) Histogram(ctx context.Context, name string, value float64, unit Unit, dims ...Dimension) {
+	m.record(ctx, KindHistogram, name, value, unit, dims)
+}
+
+// Gauge records a gauge sample
+func (m *MemoryMetrics) Gauge(ctx context.Context, name string, value float64, unit Unit, dims ...Dimension) {
+	m.record(ctx, KindGauge, name, value, unit, dims)
+}
+
+// Close is a no-op
+func (m *MemoryMetrics) Close() {}
+
+// Samples returns a copy of all recorded samples in recording order
+func (m *MemoryMetrics) Samples() []MetricSample {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	samples := make([]MetricSample, len(m.samples))
+	copy(samples, m.samples)
+	return samples
+}
+
+// Find returns the samples recorded under name with exactly the given dimensions
+func (m *MemoryMetrics) Find(name string, dims ...Dimension) []MetricSample {
+	var found []MetricSample
+	for _, sample := range m.Samples() {
+		if sample.Name == name && sameDimensions(sample.Dimensions, dims) {
+			found = append(found, sample)
+		}
+	}
+	return found
+}
+
+// Sum returns the sum of all values recorded under name with exactly the given dimensions
+func (m *MemoryMetrics) Sum(name string, dims ...Dimension) float64 {
+	var sum float64
+	for _, sample := range m.Find(name, dims...) {
+		sum += sample.Value
+	}
+	return sum
+}
+
+// Reset discards all recorded samples
+func (m *MemoryMetrics) Reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.samples = nil
+}
+
+func (m *MemoryMetrics) record(ctx context.Context, kind MetricKind, name string, value float64, unit Unit, dims []Dimension) {
+	sample := MetricSample{
+		Kind:       kind,
+		Name:       name,
+		Value:      value,
+		Unit:       unit,
+		Dimensions: append([]Dimension(nil), dims...),
+		RequestID:  getRequestID(ctx),
+	}
+	if spanContext := trace.SpanContextFromContext(ctx); spanContext.IsValid() {
+		sample.TraceID = spanContext.TraceID().String()
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.samples = append(m.samples, sample)
+}
+
+// sameDimensions reports whether a and b contain the same dimensions in any order
+func sameDimensions(a, b []Dimension) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for _, dim := range a {
+		found := false
+		for _, other := range b {
+			if dim == other {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	"go.opentelemetry.io/otel/metric"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+)
+
+// exemplarFeatureEnv enables exemplar collection, which is still behind a feature flag in the SDK
+const exemplarFeatureEnv = "OTEL_GO_X_EXEMPLAR"
+
+// httpDurationBuckets are the bucket boundaries recommended by the HTTP semantic conventions
+var httpDurationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.075, 0.1, 0.25, 0.5, 0.75, 1, 2.5, 5, 7.5, 10}
+
+// initMetrics initializes the OpenTelemetry metrics SDK, the counterpart of initTracing.
+// Metrics are exported over OTLP HTTP to the same collector endpoint as traces
+// (OTEL_EXPORTER_OTLP_ENDPOINT), and histogram buckets keep exemplars that
+// point at the sampled trace active when the value was recorded.
+// Returns a meter instance, cleanup function, and any initialization errors.
+func initMetrics() (metric.Meter, func(context.Context) error, error) {
+	// Exemplars link a histogram bucket to a trace. The SDK only records them
+	// for sampled spans, so the trace they point to is always available in X-Ray.
+	if os.Getenv(exemplarFeatureEnv) == "" {
+		os.Setenv(exemplarFeatureEnv, "true")
+	}
+
+	res, err := newResource()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	exporter, err := otlpmetrichttp.New(context.Background())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// The periodic reader exports every 60s unless OTEL_METRIC_EXPORT_INTERVAL is set
+	mp := sdkmetric.NewMeterProvider(
+		sdkmetric.WithReader(sdkmetric.NewPeriodicReader(exporter)),
+		sdkmetric.WithResource(res),
+	)
+
+	otel.SetMeterProvider(mp)
+
+	meter := otel.Meter(serviceName)
+
+	// The cleanup function flushes the last collection cycle before the application exits
+	return meter, mp.Shutdown, nil
+}
+
+// otelInstruments are the OpenTelemetry instruments recorded next to the MetricsRecorder
+type otelInstruments struct {
+	requestDuration metric.Float64Histogram
+	activeRequests  metric.Int64UpDownCounter
+	ordersCreated   metric.Int64Counter
+}
+
+func newOTelInstruments(meter metric.Meter) (*otelInstruments, error) {
+	requestDuration, err := meter.Float64Histogram("http.server.request.duration",
+		metric.WithDescription("Duration of HTTP server requests."),
+		metric.WithUnit("s"),
+		metric.WithExplicitBucketBoundaries(httpDurationBuckets...),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	activeRequests, err := meter.Int64UpDownCounter("http.server.active_requests",
+		metric.WithDescription("Number of active HTTP server requests."),
+		metric.WithUnit("{request}"),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	ordersCreated, err := meter.Int64Counter("coffee.orders.created",
+		metric.WithDescription("Number of created coffee orders."),
+		metric.WithUnit("{order}"),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &otelInstruments{
+		requestDuration: requestDuration,
+		activeRequests:  activeRequests,
+		ordersCreated:   ordersCreated,
+	}, nil
+}
+
+// recordRequest records an HTTP server request. ctx must carry the server span
+// so the exemplar references it.
+func (i *otelInstruments) recordRequest(ctx context.Context, method string, route string, statusCode int, errorType string, duration time.Duration) {
+	attrs := []attribute.KeyValue{
+		semconv.HTTPRequestMethodKey.String(method),
+		semconv.HTTPRoute(route),
+		semconv.HTTPResponseStatusCode(statusCode),
+		semconv.URLScheme("http"),
+	}
+	// Server errors carry error.type, as the HTTP semantic conventions require,
+	// and so do client errors the handler classified
+	if errorType != "" {
+		attrs = append(attrs, semconv.ErrorTypeKey.String(errorType))
+	} else if statusCode >= 500 {
+		attrs = append(attrs, semconv.ErrorTypeKey.String(strconv.Itoa(statusCode)))
+	}
+
+	i.requestDuration.Record(ctx, duration.Seconds(), metric.WithAttributes(attrs...))
+}
+
+// recordOrder records a created coffee order
+func (i *otelInstruments) recordOrder(ctx context.Context, coffeeType string) {
+	i.ordersCreated.Add(ctx, 1, metric.WithAttributes(
+		attribute.String("coffee.type", coffeeType),
+	))
+}
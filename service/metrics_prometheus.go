@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// PrometheusMetrics is a MetricsRecorder backed by a client_golang registry.
+// Metrics are created on first use, one vector per metric name and label set,
+// and served in the Prometheus exposition format.
+type PrometheusMetrics struct {
+	registry *prometheus.Registry
+	handler  http.Handler
+
+	mu         sync.Mutex
+	counters   map[string]*prometheus.CounterVec
+	histograms map[string]*prometheus.HistogramVec
+	gauges     map[string]*prometheus.GaugeVec
+}
+
+// uncheckedCollector hides the descriptors of a collector from the registry.
+// The same metric is recorded both with and without dimensions, e.g. the
+// RequestDuration total and per endpoint, and only unchecked collectors may
+// share a name with a different label set.
+type uncheckedCollector struct {
+	prometheus.Collector
+}
+
+func (uncheckedCollector) Describe(chan<- *prometheus.Desc) {}
+
+// NewPrometheusMetrics creates a PrometheusMetrics with an empty registry
+func NewPrometheusMetrics() *PrometheusMetrics {
+	registry := prometheus.NewRegistry()
+	return &PrometheusMetrics{
+		registry:   registry,
+		handler:    promhttp.HandlerFor(registry, promhttp.HandlerOpts{}),
+		counters:   make(map[string]*prometheus.CounterVec),
+		histograms: make(map[string]*prometheus.HistogramVec),
+		gauges:     make(map[string]*prometheus.GaugeVec),
+	}
+}
+
+// Counter adds value to the counter series
+func (m *PrometheusMetrics) Counter(ctx context.Context, name string, value float64, dims ...Dimension) {
+	name = promName(name, UnitCount, KindCounter)
+	labels := promLabels(dims)
+
+	m.mu.Lock()
+	vec, ok := m.counters[seriesKey(name, labels)]
+	if !ok {
+		vec = prometheus.NewCounterVec(prometheus.CounterOpts{Name: name, Help: name}, labelNames(labels))
+		m.register(vec)
+		m.counters[seriesKey(name, labels)] = vec
+	}
+	m.mu.Unlock()
+
+	vec.With(labels).Add(value)
+}
+
+// Histogram records an observation in the histogram series
+func (m *PrometheusMetrics) Histogram(ctx context.Context, name string, value float64, unit Unit, dims ...Dimension) {
+	name = promName(name, unit, KindHistogram)
+	labels := promLabels(dims)
+
+	m.mu.Lock()
+	vec, ok := m.histograms[seriesKey(name, labels)]
+	if !ok {
+		vec = prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: name, Help: name, Buckets: prometheus.DefBuckets}, labelNames(labels))
+		m.register(vec)
+		m.histograms[seriesKey(name, labels)] = vec
+	}
+	m.mu.Unlock()
+
+	vec.With(labels).Observe(value)
+}
+
+// Gauge sets the gauge series to value
+func (m *PrometheusMetrics) Gauge(ctx context.Context, name string, value float64, unit Unit, dims ...Dimension) {
+	name = promName(name, unit, KindGauge)
+	labels := promLabels(dims)
+
+	m.mu.Lock()
+	vec, ok := m.gauges[seriesKey(name, labels)]
+	if !ok {
+		vec = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: name, Help: name}, labelNames(labels))
+		m.register(vec)
+		m.gauges[seriesKey(name, labels)] = vec
+	}
+	m.mu.Unlock()
+
+	vec.With(labels).Set(value)
+}
+
+// Close is a no-op; metrics are pulled by the scraper
+func (m *PrometheusMetrics) Close() {}
+
+// ServeHTTP serves the registry in the exposition format the scraper asks for
+func (m *PrometheusMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.handler.ServeHTTP(w, r)
+}
+
+// register adds a new vector to the registry. Unchecked collectors cannot
+// collide, so registration never fails.
+func (m *PrometheusMetrics) register(collector prometheus.Collector) {
+	m.registry.MustRegister(uncheckedCollector{collector})
+}
+
+// promLabels converts dimensions into Prometheus labels with snake_case names
+func promLabels(dims []Dimension) prometheus.Labels {
+	labels := make(prometheus.Labels, len(dims))
+	for _, dim := range dims {
+		labels[snakeCase(dim.Name)] = dim.Value
+	}
+	return labels
+}
+
+// labelNames returns the sorted names of labels
+func labelNames(labels prometheus.Labels) []string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// seriesKey identifies the vector of a metric name and label set
+func seriesKey(name string, labels prometheus.Labels) string {
+	return name + "{" + strings.Join(labelNames(labels), ",") + "}"
+}
+
+// promName converts a CloudWatch style name such as RequestCount_ByEndpoint
+// into a Prometheus name such as request_count_by_endpoint_total
+func promName(name string, unit Unit, kind MetricKind) string {
+	name = snakeCase(name)
+
+	var suffix string
+	switch {
+	case kind == KindCounter:
+		suffix = "_total"
+	case unit == UnitSeconds:
+		suffix = "_seconds"
+	case unit == UnitBytes:
+		suffix = "_bytes"
+	}
+	if !strings.HasSuffix(name, suffix) {
+		name += suffix
+	}
+	return name
+}
+
+// snakeCase converts CamelCase and Camel_Case identifiers to snake_case
+func snakeCase(s string) string {
+	var b strings.Builder
+	runes := []rune(s)
+	for i, r := range runes {
+		if unicode.IsUpper(r) && i > 0 && (unicode.IsLower(runes[i-1]) || unicode.IsDigit(runes[i-1])) {
+			b.WriteByte('_')
+		}
+		b.WriteRune(unicode.ToLower(r))
+	}
+	return strings.ReplaceAll(b.String(), "__", "_")
+}
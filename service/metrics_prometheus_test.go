@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPrometheusMetricsExposition(t *testing.T) {
+	metrics := NewPrometheusMetrics()
+	ctx := context.Background()
+
+	// The same name is recorded with and without dimensions, as the route metrics are
+	metrics.Histogram(ctx, "RequestDuration", 0.2, UnitSeconds)
+	metrics.Histogram(ctx, "RequestDuration", 0.2, UnitSeconds, Dimension{Name: "Endpoint", Value: "/coffee/{id}"})
+	metrics.Counter(ctx, "RequestCount_ByEndpoint", 1, Dimension{Name: "Endpoint", Value: `/say "hi"`})
+	metrics.Counter(ctx, "RequestCount_ByEndpoint", 2, Dimension{Name: "Endpoint", Value: `/say "hi"`})
+	metrics.Gauge(ctx, "Runtime_HeapInUse", 1024, UnitBytes)
+
+	recorder := httptest.NewRecorder()
+	metrics.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("scrape status = %d, want 200", recorder.Code)
+	}
+	body, _ := io.ReadAll(recorder.Body)
+
+	for _, want := range []string{
+		"# TYPE request_duration_seconds histogram",
+		`request_duration_seconds_bucket{le="0.25"} 1`,
+		`request_duration_seconds_bucket{endpoint="/coffee/{id}",le="0.25"} 1`,
+		`request_duration_seconds_count{endpoint="/coffee/{id}"} 1`,
+		`request_count_by_endpoint_total{endpoint="/say \"hi\""} 3`,
+		"runtime_heap_in_use_bytes 1024",
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("exposition lacks %q:\n%s", want, body)
+		}
+	}
+}
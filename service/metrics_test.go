@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSendRouteMetrics(t *testing.T) {
+	recorder := NewMemoryMetrics()
+	metrics := newTestMetrics(t, recorder)
+	ctx := context.Background()
+
+	metrics.sendRouteMetrics(ctx, http.MethodGet, "/coffee/{id}", http.StatusOK, "", 20*time.Millisecond)
+	metrics.sendRouteMetrics(ctx, http.MethodGet, "/coffee/{id}", http.StatusNotFound, string(KindNotFound), 5*time.Millisecond)
+
+	if got := recorder.Sum("RequestCount"); got != 2 {
+		t.Errorf("RequestCount = %g, want 2", got)
+	}
+	if got := len(recorder.Find("RequestDuration")); got != 2 {
+		t.Errorf("recorded %d RequestDuration values, want 2", got)
+	}
+	endpoint := Dimension{Name: "Endpoint", Value: "/coffee/{id}"}
+	if got := len(recorder.Find("RequestDuration", endpoint)); got != 2 {
+		t.Errorf("recorded %d RequestDuration{Endpoint} values, want 2", got)
+	}
+	if got := recorder.Sum("RequestCount_ByEndpoint", endpoint); got != 2 {
+		t.Errorf("RequestCount_ByEndpoint{Endpoint} = %g, want 2", got)
+	}
+
+	notFound := []Dimension{
+		{Name: "Endpoint", Value: "/coffee/{id}"},
+		{Name: "Method", Value: http.MethodGet},
+		{Name: "StatusClass", Value: "4xx"},
+	}
+	if got := recorder.Sum("RequestCount_ByStatusClass", notFound...); got != 1 {
+		t.Errorf("RequestCount_ByStatusClass%v = %g, want 1", notFound, got)
+	}
+	if got := recorder.Sum("RequestErrors", notFound...); got != 1 {
+		t.Errorf("RequestErrors%v = %g, want 1", notFound, got)
+	}
+	if got := recorder.Sum("RequestErrors_ByType", Dimension{Name: "ErrorType", Value: "not_found"}); got != 1 {
+		t.Errorf("RequestErrors_ByType{not_found} = %g, want 1", got)
+	}
+}
+
+func TestSendRouteMetricsNormalizesUnknownMethods(t *testing.T) {
+	recorder := NewMemoryMetrics()
+	metrics := newTestMetrics(t, recorder)
+
+	metrics.sendRouteMetrics(context.Background(), "BREW", "/coffee", http.StatusMethodNotAllowed, "", time.Millisecond)
+
+	dims := []Dimension{
+		{Name: "Endpoint", Value: "/coffee"},
+		{Name: "Method", Value: "_OTHER"},
+		{Name: "StatusClass", Value: "4xx"},
+	}
+	if got := recorder.Sum("RequestCount_ByStatusClass", dims...); got != 1 {
+		t.Errorf("RequestCount_ByStatusClass%v = %g, want 1", dims, got)
+	}
+}
+
+func TestAsyncMetricsAreDroppedAfterWait(t *testing.T) {
+	recorder := NewMemoryMetrics()
+	metrics := newTestMetrics(t, recorder)
+	ctx := context.Background()
+
+	metrics.sendCreatedCoffeeOrderMetricsAsync(ctx, "latte", "tom")
+	if err := metrics.Wait(ctx); err != nil {
+		t.Fatal(err)
+	}
+	metrics.sendCreatedCoffeeOrderMetricsAsync(ctx, "latte", "tom")
+
+	if got := recorder.Sum("CreatedCoffeeOrders_Total"); got != 1 {
+		t.Errorf("CreatedCoffeeOrders_Total = %g, want 1: the order sent after Wait is dropped", got)
+	}
+}
+
+func TestUnknownCoffeeTypesDoNotTakeCoffeeTypeSlots(t *testing.T) {
+	recorder := NewMemoryMetrics()
+	metrics := newTestMetrics(t, recorder)
+	ctx := context.Background()
+
+	for i := 0; i < 30; i++ {
+		metrics.sendUnknownCoffeeTypeMetrics(ctx, "junk-"+strconv.Itoa(i))
+	}
+	metrics.sendCreatedCoffeeOrderMetrics(ctx, "mocha", "tom")
+
+	if got := recorder.Sum("CreatedCoffeeOrders_ByType", Dimension{Name: "CoffeeType", Value: "mocha"}); got != 1 {
+		t.Errorf("CreatedCoffeeOrders_ByType{mocha} = %g, want 1", got)
+	}
+	if got := recorder.Sum("UnknownCoffeeTypeOrders_ByType", Dimension{Name: "UnknownCoffeeType", Value: OtherDimensionValue}); got != 10 {
+		t.Errorf("UnknownCoffeeTypeOrders_ByType{__other__} = %g, want the 10 types over the limit", got)
+	}
+}
+
+func TestUnmatchedRequestsHaveAnEndpoint(t *testing.T) {
+	app := newTestApp(t)
+
+	app.serve(httptest.NewRequest(http.MethodGet, "/wp-admin", nil))
+
+	if got := app.recorder.Sum("RequestCount_ByEndpoint", Dimension{Name: "Endpoint", Value: unmatchedEndpoint}); got != 1 {
+		t.Errorf("RequestCount_ByEndpoint{unmatched} = %g, want 1: %+v", got, app.recorder.Samples())
+	}
+	for _, sample := range app.recorder.Samples() {
+		for _, dim := range sample.Dimensions {
+			if dim.Value == "" {
+				t.Errorf("%s has an empty %s dimension", sample.Name, dim.Name)
+			}
+		}
+	}
+}
@@ -3,15 +3,21 @@ package main
 import (
 	"context"
 	"fmt"
+	"net"
 	"net/http"
+	"runtime/debug"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
+	"go.opentelemetry.io/contrib/propagators/aws/xray"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/codes"
 	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
 	"go.opentelemetry.io/otel/trace"
 )
 
@@ -20,20 +26,55 @@ type contextKey string
 
 const requestIDKey contextKey = "request_id"
 
-// loggingMiddleware logs HTTP requests and responses and adds request ID to response headers
+// errorTypeKey holds the *ErrorKind that writeProblem fills in, so the tracing
+// and metrics stages can read the kind of error the response reported
+const errorTypeKey contextKey = "error_type"
+
+// observabilityMiddleware runs the observability stages in the order each one
+// depends on: request ID, trace, log, metrics, response headers, recovery.
+// Every stage shares one responseWriter wrapper, so the request ID, trace ID
+// and status code agree across the log line, the span, the metric and the
+// response. Panics are recovered by the innermost stage, so the outer stages
+// see the 500 response like any other.
+func (app *App) observabilityMiddleware(next http.Handler) http.Handler {
+	return app.requestIDMiddleware(
+		app.tracingMiddleware(
+			app.loggingMiddleware(
+				app.metricsMiddleware(
+					app.responseHeadersMiddleware(
+						app.recoverMiddleware(next),
+					),
+				),
+			),
+		),
+	)
+}
+
+// requestIDMiddleware assigns the request ID, reusing an incoming X-Request-Id
+// header, and stores it in the context for the later stages, together with
+// the holder of the response error type
+func (app *App) requestIDMiddleware(next http.Handler) http.Handler {
+	return middleware.RequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), requestIDKey, middleware.GetReqID(r.Context()))
+		ctx = context.WithValue(ctx, errorTypeKey, new(ErrorKind))
+		next.ServeHTTP(w, r.WithContext(ctx))
+	}))
+}
+
+// loggingMiddleware logs HTTP requests and responses
 func (app *App) loggingMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
-		requestID := middleware.GetReqID(r.Context())
-		traceID := trace.SpanFromContext(r.Context()).SpanContext().TraceID().String()
 
-		ctx := context.WithValue(r.Context(), requestIDKey, requestID)
+		// Lower the level for this request only if a trusted caller asked for debug logging
+		ctx := r.Context()
+		if app.trustedCaller(r) {
+			ctx = withDebugLogging(ctx, r)
+		}
 		r = r.WithContext(ctx)
 
-		// Log request
-		app.logger.Info("Request started",
-			"request_id", requestID,
-			"trace_id", traceID,
+		// Log request; the context handler adds request_id and trace_id
+		app.logger.InfoContext(ctx, "Request started",
 			"method", r.Method,
 			"path", r.URL.Path,
 			"remote_addr", r.RemoteAddr,
@@ -41,38 +82,40 @@ func (app *App) loggingMiddleware(next http.Handler) http.Handler {
 		)
 
 		// Wrap response writer to capture status code
-		wrapped := &responseWriter{ResponseWriter: w, statusCode: http.StatusOK}
+		wrapped := wrapResponseWriter(w)
 
 		next.ServeHTTP(wrapped, r)
 
 		// Log response
 		duration := time.Since(start)
-		app.logger.Info("Request completed",
-			"request_id", requestID,
-			"trace_id", traceID,
+		app.logger.InfoContext(ctx, "Request completed",
 			"status_code", wrapped.statusCode,
 			"duration", duration,
 		)
 	})
 }
 
-// tracingMiddleware handles OpenTelemetry tracing and adds trace ID to response headers
+// tracingMiddleware handles OpenTelemetry tracing and adds trace ID to response headers.
+// Spans follow the OpenTelemetry HTTP server semantic conventions and are named
+// after the chi route pattern, which is only known once the router has matched.
 func (app *App) tracingMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Extract trace context from headers
 		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
-		// Create span
-		spanName := fmt.Sprintf("%s %s", r.Method, r.URL.Path)
-		ctx, span := app.tracer.Start(ctx, spanName)
+		// Create span, named after the method until the route is resolved.
+		// The path is set at start so the sampler can apply the per-route rules.
+		spanMethod := normalizeMethod(r.Method)
+		if spanMethod == otherMethod {
+			spanMethod = "HTTP"
+		}
+		ctx, span := app.tracer.Start(ctx, spanMethod,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(semconv.URLPath(r.URL.Path)),
+		)
 		defer span.End()
 
 		// Add span attributes
-		span.SetAttributes(
-			attribute.String("http.method", r.Method),
-			attribute.String("http.url", r.URL.String()),
-			attribute.String("http.user_agent", r.UserAgent()),
-			attribute.String("http.remote_addr", r.RemoteAddr),
-		)
+		span.SetAttributes(requestAttributes(r, app.redactor)...)
 
 		// Add request ID to span
 		if requestID := getRequestID(ctx); requestID != "" {
@@ -83,18 +126,95 @@ func (app *App) tracingMiddleware(next http.Handler) http.Handler {
 		r = r.WithContext(ctx)
 
 		// Wrap response writer to capture status code
-		wrapped := &responseWriter{ResponseWriter: w, statusCode: http.StatusOK}
+		wrapped := wrapResponseWriter(w)
+
+		// Finish the span after the handler returns; panics have already been
+		// turned into a 500 response by recoverMiddleware
+		defer func() {
+			statusCode := wrapped.statusCode
+
+			// Name the span after the route pattern, e.g. "GET /coffee/{id}"
+			if routePattern := chi.RouteContext(ctx).RoutePattern(); routePattern != "" {
+				span.SetName(spanMethod + " " + routePattern)
+				span.SetAttributes(semconv.HTTPRoute(routePattern))
+			}
+
+			// Set span status and attributes. Server spans are only errors on 5xx;
+			// 4xx responses are the client's fault and leave the status unset.
+			span.SetAttributes(
+				semconv.HTTPResponseStatusCode(statusCode),
+				semconv.HTTPResponseBodySize(wrapped.bytesWritten),
+			)
+			// error.type is the kind of error the handler reported, falling back
+			// to the status code for server errors it did not classify
+			if errorType := getErrorType(ctx); errorType != "" {
+				span.SetAttributes(semconv.ErrorTypeKey.String(string(errorType)))
+			} else if statusCode >= 500 {
+				span.SetAttributes(semconv.ErrorTypeKey.String(strconv.Itoa(statusCode)))
+			}
+			if statusCode >= 500 {
+				span.SetStatus(codes.Error, fmt.Sprintf("HTTP %d", statusCode))
+			}
+		}()
 
 		next.ServeHTTP(wrapped, r)
+	})
+}
+
+// requestAttributes returns the HTTP server semantic convention attributes of r.
+// Sensitive query parameters are redacted by redactor.
+func requestAttributes(r *http.Request, redactor *Redactor) []attribute.KeyValue {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+
+	method := normalizeMethod(r.Method)
+	attrs := []attribute.KeyValue{
+		semconv.HTTPRequestMethodKey.String(method),
+		semconv.URLScheme(scheme),
+		semconv.UserAgentOriginal(r.UserAgent()),
+		semconv.NetworkProtocolVersion(fmt.Sprintf("%d.%d", r.ProtoMajor, r.ProtoMinor)),
+	}
+	if method != r.Method {
+		attrs = append(attrs, semconv.HTTPRequestMethodOriginal(r.Method))
+	}
+	if r.URL.RawQuery != "" {
+		attrs = append(attrs, semconv.URLQuery(redactor.RedactQuery(r.URL.RawQuery)))
+	}
+	if r.ContentLength > 0 {
+		attrs = append(attrs, semconv.HTTPRequestBodySize(int(r.ContentLength)))
+	}
 
-		// Set span status and attributes
-		span.SetAttributes(attribute.Int("http.status_code", wrapped.statusCode))
-		if wrapped.statusCode >= 400 {
-			span.SetStatus(codes.Error, fmt.Sprintf("HTTP %d", wrapped.statusCode))
-		} else {
-			span.SetStatus(codes.Ok, "")
+	host, port := splitHostPort(r.Host)
+	attrs = append(attrs, semconv.ServerAddress(host))
+	if port > 0 {
+		attrs = append(attrs, semconv.ServerPort(port))
+	}
+
+	// Behind the ALB the peer is the load balancer; the client is the first X-Forwarded-For hop
+	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+		client, _, _ := strings.Cut(forwarded, ",")
+		attrs = append(attrs, semconv.ClientAddress(strings.TrimSpace(client)))
+	} else {
+		clientHost, clientPort := splitHostPort(r.RemoteAddr)
+		attrs = append(attrs, semconv.ClientAddress(clientHost))
+		if clientPort > 0 {
+			attrs = append(attrs, semconv.ClientPort(clientPort))
 		}
-	})
+	}
+
+	return attrs
+}
+
+// splitHostPort splits "host:port", returning port 0 if there is none
+func splitHostPort(hostport string) (string, int) {
+	host, portStr, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return hostport, 0
+	}
+	port, _ := strconv.Atoi(portStr)
+	return host, port
 }
 
 // metricsMiddleware handles CloudWatch metrics
@@ -103,13 +223,19 @@ func (app *App) metricsMiddleware(next http.Handler) http.Handler {
 		ctx := r.Context()
 		start := time.Now()
 
-		next.ServeHTTP(w, r)
+		done := app.metrics.trackActiveRequest(ctx, r.Method)
+		defer done()
+
+		// Reuse the wrapper of the outer middleware to capture status code
+		wrapped := wrapResponseWriter(w)
+
+		next.ServeHTTP(wrapped, r)
 
 		duration := time.Since(start)
 
-		// Send metrics to CloudWatch
+		// Queue metrics for the next CloudWatch flush
 		routePattern := chi.RouteContext(ctx).RoutePattern()
-		go app.metrics.sendRouteMetrics(ctx, routePattern, duration)
+		app.metrics.sendRouteMetrics(ctx, r.Method, routePattern, wrapped.statusCode, string(getErrorType(ctx)), duration)
 	})
 }
 
@@ -127,12 +253,68 @@ func (app *App) responseHeadersMiddleware(next http.Handler) http.Handler {
 		if span.SpanContext().IsValid() {
 			traceID := span.SpanContext().TraceID().String()
 			w.Header().Set("X-Trace-ID", traceID)
+
+			// Echo the trace in X-Ray format so clients behind the ALB can look it up
+			if app.xray {
+				xray.Propagator{}.Inject(r.Context(), propagation.HeaderCarrier(w.Header()))
+			}
 		}
 
 		next.ServeHTTP(w, r)
 	})
 }
 
+// recoverMiddleware responds 500 when the handler panics. The panic is
+// recorded on the span and logged with its stack, with the request ID and
+// trace ID of the request. A panic with http.ErrAbortHandler is re-raised, so
+// the server aborts the response as intended.
+func (app *App) recoverMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			rec := recover()
+			if rec == nil {
+				return
+			}
+			if rec == http.ErrAbortHandler {
+				panic(rec)
+			}
+
+			ctx := r.Context()
+			err := fmt.Errorf("panic: %v", rec)
+			trace.SpanFromContext(ctx).RecordError(err, trace.WithStackTrace(true))
+			app.logger.ErrorContext(ctx, "Request handler panicked",
+				"error", err,
+				"error_type", KindInternal,
+				"method", r.Method,
+				"path", r.URL.Path,
+				"stack", string(debug.Stack()),
+			)
+
+			// A response that has already started cannot be replaced
+			if !wrapResponseWriter(w).wroteHeader {
+				writeProblem(w, r, KindInternal, "Internal server error")
+			}
+		}()
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// setErrorType records the kind of error the response reports
+func setErrorType(ctx context.Context, kind ErrorKind) {
+	if errorType, ok := ctx.Value(errorTypeKey).(*ErrorKind); ok {
+		*errorType = kind
+	}
+}
+
+// getErrorType returns the kind of error the response reported, if any
+func getErrorType(ctx context.Context) ErrorKind {
+	if errorType, ok := ctx.Value(errorTypeKey).(*ErrorKind); ok {
+		return *errorType
+	}
+	return ""
+}
+
 // getRequestID extracts request ID from context
 func getRequestID(ctx context.Context) string {
 	if requestID, ok := ctx.Value(requestIDKey).(string); ok {
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TestObservabilityAgrees checks that the request ID, trace ID and status code
+// of a request are the same in the response headers, the "Request completed"
+// log line, the server span and the request metrics
+func TestObservabilityAgrees(t *testing.T) {
+	tests := []struct {
+		name       string
+		path       string
+		wantStatus int
+	}{
+		{name: "success", path: "/coffee/1", wantStatus: http.StatusOK},
+		{name: "error", path: "/coffee/999", wantStatus: http.StatusNotFound},
+		{name: "panic", path: "/panic", wantStatus: http.StatusInternalServerError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t)
+			app.router.(*chi.Mux).Get("/panic", func(w http.ResponseWriter, r *http.Request) {
+				panic("out of beans")
+			})
+			if _, err := app.repository.CreateCoffeeOrder(context.Background(), CreateCoffeeOrder{UserName: "tom", CoffeeType: "latte"}); err != nil {
+				t.Fatal(err)
+			}
+
+			w := app.serve(httptest.NewRequest(http.MethodGet, tt.path, nil))
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+
+			requestID := w.Header().Get("X-Request-ID")
+			traceID := w.Header().Get("X-Trace-ID")
+			if requestID == "" || traceID == "" {
+				t.Fatalf("response headers X-Request-ID = %q, X-Trace-ID = %q", requestID, traceID)
+			}
+
+			// Log line
+			var completed map[string]any
+			for _, line := range app.logLines(t) {
+				if line["msg"] == "Request completed" {
+					completed = line
+				}
+			}
+			if completed == nil {
+				t.Fatal("no Request completed log line")
+			}
+			if completed["request_id"] != requestID || completed["trace_id"] != traceID || completed["status_code"] != float64(tt.wantStatus) {
+				t.Errorf("log line request_id = %v, trace_id = %v, status_code = %v; want %s, %s, %d",
+					completed["request_id"], completed["trace_id"], completed["status_code"], requestID, traceID, tt.wantStatus)
+			}
+
+			// Span
+			span := serverSpan(t, app.spans.Ended())
+			attrs := map[string]string{}
+			for _, attr := range span.Attributes() {
+				attrs[string(attr.Key)] = attr.Value.Emit()
+			}
+			if span.SpanContext().TraceID().String() != traceID || attrs["request.id"] != requestID || attrs[string(semconv.HTTPResponseStatusCodeKey)] != strconv.Itoa(tt.wantStatus) {
+				t.Errorf("span trace ID = %s, request.id = %s, status code = %s; want %s, %s, %d",
+					span.SpanContext().TraceID(), attrs["request.id"], attrs[string(semconv.HTTPResponseStatusCodeKey)], traceID, requestID, tt.wantStatus)
+			}
+
+			// Metric datum
+			samples := app.recorder.Find("RequestCount_ByStatusClass",
+				Dimension{Name: "Endpoint", Value: attrs[string(semconv.HTTPRouteKey)]},
+				Dimension{Name: "Method", Value: http.MethodGet},
+				Dimension{Name: "StatusClass", Value: statusClass(tt.wantStatus)},
+			)
+			if len(samples) != 1 {
+				t.Fatalf("recorded %d RequestCount_ByStatusClass samples with status class %s, want 1: %+v",
+					len(samples), statusClass(tt.wantStatus), app.recorder.Samples())
+			}
+			if samples[0].RequestID != requestID || samples[0].TraceID != traceID {
+				t.Errorf("metric request ID = %s, trace ID = %s; want %s, %s", samples[0].RequestID, samples[0].TraceID, requestID, traceID)
+			}
+		})
+	}
+}
+
+func TestPanicIsLoggedWithRequestID(t *testing.T) {
+	app := newTestApp(t)
+	app.router.(*chi.Mux).Get("/panic", func(w http.ResponseWriter, r *http.Request) {
+		panic("out of beans")
+	})
+
+	w := app.serve(httptest.NewRequest(http.MethodGet, "/panic", nil))
+
+	var logged bool
+	for _, line := range app.logLines(t) {
+		if line["msg"] == "Request handler panicked" {
+			logged = true
+			if line["request_id"] != w.Header().Get("X-Request-ID") || line["error_type"] != string(KindInternal) {
+				t.Errorf("panic log line = %v, want request ID %s", line, w.Header().Get("X-Request-ID"))
+			}
+		}
+	}
+	if !logged {
+		t.Error("panic was not logged")
+	}
+
+	span := serverSpan(t, app.spans.Ended())
+	if len(span.Events()) == 0 || span.Events()[0].Name != "exception" {
+		t.Errorf("span events = %v, want the panic recorded as an exception", span.Events())
+	}
+}
+
+// serverSpan returns the only server span of spans
+func serverSpan(t *testing.T, spans []sdktrace.ReadOnlySpan) sdktrace.ReadOnlySpan {
+	t.Helper()
+
+	var server []sdktrace.ReadOnlySpan
+	for _, span := range spans {
+		if span.SpanKind() == trace.SpanKindServer {
+			server = append(server, span)
+		}
+	}
+	if len(server) != 1 {
+		t.Fatalf("recorded %d server spans, want 1", len(server))
+	}
+	return server[0]
+}
+
+func TestErrorTypeSurvivesWrappedResponseWriter(t *testing.T) {
+	app := newTestApp(t)
+	router := chi.NewRouter()
+	router.Use(app.observabilityMiddleware)
+	router.Get("/coffee/{id}", func(w http.ResponseWriter, r *http.Request) {
+		// A writer wrapped by another middleware is not the shared responseWriter
+		wrapped := struct{ http.ResponseWriter }{w}
+		app.returnErrorResponse(wrapped, r, "Failed to get coffee order", NotFoundError(errors.New("coffee order 1 not found")))
+	})
+
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/coffee/1", nil))
+
+	if got := app.recorder.Sum("RequestErrors_ByType", Dimension{Name: "ErrorType", Value: string(KindNotFound)}); got != 1 {
+		t.Errorf("RequestErrors_ByType{not_found} = %g, want 1", got)
+	}
+	var spanErrorType string
+	for _, attr := range serverSpan(t, app.spans.Ended()).Attributes() {
+		if attr.Key == semconv.ErrorTypeKey {
+			spanErrorType = attr.Value.AsString()
+		}
+	}
+	if spanErrorType != string(KindNotFound) {
+		t.Errorf("span error.type = %q, want not_found", spanErrorType)
+	}
+}
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// migrationLockKey is the advisory lock held while migrating, so ECS tasks
+// starting at the same time apply each migration once
+const migrationLockKey int64 = 0x636f66666565 // "coffee"
+
+// createMigrationsTable records the applied migrations, one row per version
+const createMigrationsTable = `
+CREATE TABLE IF NOT EXISTS schema_migrations (
+	version BIGINT PRIMARY KEY,
+	name VARCHAR(255) NOT NULL,
+	applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+`
+
+// migrationFileName matches migration files such as 0002_create_coffee_types.up.sql
+var migrationFileName = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// Migration is one versioned schema change with the SQL to apply and revert it
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// MigrationStatus is a migration and when it was applied, if it was
+type MigrationStatus struct {
+	Version   int        `json:"version"`
+	Name      string     `json:"name"`
+	AppliedAt *time.Time `json:"applied_at,omitempty"`
+}
+
+// Migrator applies the embedded migrations and records them in the
+// schema_migrations table
+type Migrator struct {
+	db         *Database
+	logger     *slog.Logger
+	tracer     trace.Tracer
+	migrations []Migration
+}
+
+// NewMigrator creates a Migrator for the migrations embedded in the binary
+func NewMigrator(db *Database, logger *slog.Logger, tracer trace.Tracer) (*Migrator, error) {
+	migrations, err := loadMigrations(migrationFiles, "migrations")
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{db: db, logger: logger, tracer: tracer, migrations: migrations}, nil
+}
+
+// loadMigrations reads the migrations in dir, sorted by version. Versions must
+// be unique and every migration needs both an up and a down file.
+func loadMigrations(fsys fs.FS, dir string) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int]*Migration)
+	for _, entry := range entries {
+		match := migrationFileName.FindStringSubmatch(entry.Name())
+		if match == nil {
+			return nil, fmt.Errorf("invalid migration file name %q", entry.Name())
+		}
+		version, _ := strconv.Atoi(match[1])
+
+		content, err := fs.ReadFile(fsys, path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		migration, ok := byVersion[version]
+		if !ok {
+			migration = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = migration
+		} else if migration.Name != match[2] {
+			return nil, fmt.Errorf("migration %d has two names, %q and %q", version, migration.Name, match[2])
+		}
+
+		// Versions are compared as numbers, so 1_x and 0001_x are the same migration
+		sql := &migration.Down
+		if match[3] == "up" {
+			sql = &migration.Up
+		}
+		if *sql != "" {
+			return nil, fmt.Errorf("migration %d_%s has two %s files", version, migration.Name, match[3])
+		}
+		*sql = string(content)
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, migration := range byVersion {
+		if migration.Up == "" || migration.Down == "" {
+			return nil, fmt.Errorf("migration %d_%s needs both an up and a down file", migration.Version, migration.Name)
+		}
+		migrations = append(migrations, *migration)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	return migrations, nil
+}
+
+// Latest returns the version of the newest migration
+func (m *Migrator) Latest() int {
+	if len(m.migrations) == 0 {
+		return 0
+	}
+	return m.migrations[len(m.migrations)-1].Version
+}
+
+// Status lists every migration and when it was applied
+func (m *Migrator) Status(ctx context.Context) ([]MigrationStatus, error) {
+	if _, err := m.db.pool.Exec(ctx, createMigrationsTable); err != nil {
+		return nil, err
+	}
+
+	rows, err := m.db.pool.Query(ctx, "SELECT version, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	applied := make(map[int]time.Time)
+	var version int
+	var appliedAt time.Time
+	if _, err := pgx.ForEachRow(rows, []any{&version, &appliedAt}, func() error {
+		applied[version] = appliedAt
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	statuses := make([]MigrationStatus, len(m.migrations))
+	for i, migration := range m.migrations {
+		statuses[i] = MigrationStatus{Version: migration.Version, Name: migration.Name}
+		if appliedAt, ok := applied[migration.Version]; ok {
+			statuses[i].AppliedAt = &appliedAt
+		}
+	}
+	return statuses, nil
+}
+
+// Ready checks that every migration has been applied
+func (m *Migrator) Ready(ctx context.Context) error {
+	var version int
+	err := m.db.pool.QueryRow(ctx, "SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&version)
+	if err != nil {
+		return err
+	}
+	if version < m.Latest() {
+		return fmt.Errorf("schema is at version %d, want %d", version, m.Latest())
+	}
+	return nil
+}
+
+// Up applies every pending migration
+func (m *Migrator) Up(ctx context.Context) error {
+	return m.To(ctx, m.Latest())
+}
+
+// Down reverts the newest applied migration
+func (m *Migrator) Down(ctx context.Context) error {
+	return m.migrate(ctx, "down", m.previous)
+}
+
+// previous returns the version of the newest migration older than current,
+// or 0 if there is none
+func (m *Migrator) previous(current int) int {
+	for i := len(m.migrations) - 1; i >= 0; i-- {
+		if m.migrations[i].Version < current {
+			return m.migrations[i].Version
+		}
+	}
+	return 0
+}
+
+// To applies or reverts migrations until the schema is at version. Version 0
+// reverts every migration.
+func (m *Migrator) To(ctx context.Context, version int) error {
+	if version != 0 && !m.exists(version) {
+		return fmt.Errorf("unknown migration version %d", version)
+	}
+	return m.migrate(ctx, "to", func(int) int { return version })
+}
+
+func (m *Migrator) exists(version int) bool {
+	for _, migration := range m.migrations {
+		if migration.Version == version {
+			return true
+		}
+	}
+	return false
+}
+
+// migrate holds the advisory lock, reads the current version and moves the
+// schema to the version target returns for it. Each migration runs in its own
+// transaction together with its schema_migrations change, in its own span.
+func (m *Migrator) migrate(ctx context.Context, command string, target func(current int) int) (err error) {
+	ctx, span := m.tracer.Start(ctx, "migrate."+command)
+	defer func() {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}()
+
+	conn, err := m.db.pool.Acquire(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to acquire connection: %w", err)
+	}
+	defer conn.Release()
+
+	// The lock is held by the session, so it must be taken and released on the same connection
+	if _, err := conn.Exec(ctx, "SELECT pg_advisory_lock($1)", migrationLockKey); err != nil {
+		return fmt.Errorf("failed to acquire migration lock: %w", err)
+	}
+	defer conn.Exec(context.WithoutCancel(ctx), "SELECT pg_advisory_unlock($1)", migrationLockKey)
+
+	if _, err := conn.Exec(ctx, createMigrationsTable); err != nil {
+		return err
+	}
+
+	var current int
+	if err := conn.QueryRow(ctx, "SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&current); err != nil {
+		return err
+	}
+	want := target(current)
+	span.SetAttributes(
+		attribute.Int("migration.from_version", current),
+		attribute.Int("migration.to_version", want),
+	)
+
+	if want == current {
+		m.logger.InfoContext(ctx, "Schema is up to date", "version", current)
+		return nil
+	}
+
+	migrations, direction := m.plan(current, want)
+	for _, migration := range migrations {
+		if err := m.apply(ctx, conn, migration, direction); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// plan returns the migrations that move the schema from version current to
+// version want, in the order they run, and the direction they run in
+func (m *Migrator) plan(current int, want int) ([]Migration, string) {
+	var migrations []Migration
+	if want >= current {
+		for _, migration := range m.migrations {
+			if migration.Version > current && migration.Version <= want {
+				migrations = append(migrations, migration)
+			}
+		}
+		return migrations, "up"
+	}
+
+	for i := len(m.migrations) - 1; i >= 0; i-- {
+		migration := m.migrations[i]
+		if migration.Version <= current && migration.Version > want {
+			migrations = append(migrations, migration)
+		}
+	}
+	return migrations, "down"
+}
+
+// apply runs one migration in the given direction
+func (m *Migrator) apply(ctx context.Context, conn *pgxpool.Conn, migration Migration, direction string) (err error) {
+	ctx, span := m.tracer.Start(ctx, fmt.Sprintf("migration %s %d_%s", direction, migration.Version, migration.Name),
+		trace.WithAttributes(
+			attribute.Int("migration.version", migration.Version),
+			attribute.String("migration.name", migration.Name),
+			attribute.String("migration.direction", direction),
+		),
+	)
+	defer func() {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}()
+
+	start := time.Now()
+	err = pgx.BeginFunc(ctx, conn, func(tx pgx.Tx) error {
+		if direction == "up" {
+			if _, err := tx.Exec(ctx, migration.Up); err != nil {
+				return err
+			}
+			_, err := tx.Exec(ctx, "INSERT INTO schema_migrations (version, name) VALUES ($1, $2)", migration.Version, migration.Name)
+			return err
+		}
+
+		if _, err := tx.Exec(ctx, migration.Down); err != nil {
+			return err
+		}
+		_, err := tx.Exec(ctx, "DELETE FROM schema_migrations WHERE version = $1", migration.Version)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("migration %d_%s %s failed: %w", migration.Version, migration.Name, direction, err)
+	}
+
+	m.logger.InfoContext(ctx, "Migration applied",
+		"version", migration.Version,
+		"name", migration.Name,
+		"direction", direction,
+		"duration", time.Since(start),
+	)
+	return nil
+}
+
+// runMigrate runs the migrate subcommand and returns the exit code:
+//
+//	migrate status        list the migrations and when they were applied
+//	migrate up            apply every pending migration
+//	migrate down          revert the newest applied migration
+//	migrate to VERSION    apply or revert migrations until the schema is at VERSION
+func runMigrate(ctx context.Context, migrator *Migrator, args []string, logger *slog.Logger) int {
+	usage := "usage: migrate status | up | down | to VERSION"
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, usage)
+		return 2
+	}
+
+	var err error
+	switch args[0] {
+	case "status":
+		var statuses []MigrationStatus
+		statuses, err = migrator.Status(ctx)
+		if err == nil {
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED AT")
+			for _, status := range statuses {
+				appliedAt := "pending"
+				if status.AppliedAt != nil {
+					appliedAt = status.AppliedAt.Format(time.RFC3339)
+				}
+				fmt.Fprintf(w, "%d\t%s\t%s\n", status.Version, status.Name, appliedAt)
+			}
+			w.Flush()
+		}
+	case "up":
+		err = migrator.Up(ctx)
+	case "down":
+		err = migrator.Down(ctx)
+	case "to":
+		if len(args) != 2 {
+			fmt.Fprintln(os.Stderr, usage)
+			return 2
+		}
+		version, convErr := strconv.Atoi(args[1])
+		if convErr != nil {
+			fmt.Fprintf(os.Stderr, "invalid version %q\n", args[1])
+			return 2
+		}
+		err = migrator.To(ctx, version)
+	default:
+		fmt.Fprintln(os.Stderr, usage)
+		return 2
+	}
+
+	if err != nil {
+		logger.Error("Migration failed", "command", args[0], "error", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1 @@
+DROP TABLE coffee_orders;
@@ -0,0 +1,7 @@
+-- IF NOT EXISTS adopts databases created before migrations were versioned
+CREATE TABLE IF NOT EXISTS coffee_orders (
+	id SERIAL PRIMARY KEY,
+	user_name VARCHAR(255) NOT NULL,
+	coffee_type VARCHAR(255) NOT NULL,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
@@ -0,0 +1,11 @@
+-- coffee_orders.coffee_type has no foreign key to the catalog, so orders
+-- that bypass the API checks, such as Matus' borovicka, are still saved
+CREATE TABLE IF NOT EXISTS coffee_types (
+	name VARCHAR(50) PRIMARY KEY,
+	active BOOLEAN NOT NULL DEFAULT TRUE
+);
+
+INSERT INTO coffee_types (name) VALUES
+	('espresso'), ('doppio'), ('americano'), ('cappuccino'), ('latte'),
+	('flat_white'), ('cortado'), ('macchiato'), ('mocha')
+ON CONFLICT (name) DO NOTHING;
@@ -0,0 +1,3 @@
+DROP INDEX coffee_orders_coffee_type_created_at_id_idx;
+DROP INDEX coffee_orders_user_name_created_at_id_idx;
+DROP INDEX coffee_orders_created_at_id_idx;
@@ -0,0 +1,5 @@
+-- Keyset pagination of GET /coffee walks (created_at, id) in either direction,
+-- optionally filtered by user or coffee type first
+CREATE INDEX IF NOT EXISTS coffee_orders_created_at_id_idx ON coffee_orders (created_at, id);
+CREATE INDEX IF NOT EXISTS coffee_orders_user_name_created_at_id_idx ON coffee_orders (user_name, created_at, id);
+CREATE INDEX IF NOT EXISTS coffee_orders_coffee_type_created_at_id_idx ON coffee_orders (coffee_type, created_at, id);
@@ -0,0 +1 @@
+ALTER TABLE coffee_orders DROP COLUMN status;
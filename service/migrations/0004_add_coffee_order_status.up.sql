@@ -0,0 +1,4 @@
+-- Existing orders start in the placed state
+ALTER TABLE coffee_orders
+	ADD COLUMN status VARCHAR(20) NOT NULL DEFAULT 'placed'
+	CONSTRAINT coffee_orders_status_check CHECK (status IN ('placed', 'brewing', 'ready', 'picked_up', 'cancelled'));
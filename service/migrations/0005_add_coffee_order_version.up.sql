@@ -0,0 +1,2 @@
+-- Incremented by every update, so clients can detect concurrent changes with If-Match
+ALTER TABLE coffee_orders ADD COLUMN version INTEGER NOT NULL DEFAULT 1;
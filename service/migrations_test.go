@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestLoadMigrations(t *testing.T) {
+	fsys := fstest.MapFS{
+		"migrations/0010_add_index.up.sql":      {Data: []byte("CREATE INDEX")},
+		"migrations/0010_add_index.down.sql":    {Data: []byte("DROP INDEX")},
+		"migrations/0002_create_table.up.sql":   {Data: []byte("CREATE TABLE")},
+		"migrations/0002_create_table.down.sql": {Data: []byte("DROP TABLE")},
+	}
+
+	migrations, err := loadMigrations(fsys, "migrations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Migration{
+		{Version: 2, Name: "create_table", Up: "CREATE TABLE", Down: "DROP TABLE"},
+		// Sorted by version as a number, not by file name
+		{Version: 10, Name: "add_index", Up: "CREATE INDEX", Down: "DROP INDEX"},
+	}
+	if !slices.Equal(migrations, want) {
+		t.Errorf("migrations = %+v, want %+v", migrations, want)
+	}
+}
+
+func TestLoadMigrationsErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		files   []string
+		wantErr string
+	}{
+		{name: "missing down file", files: []string{"0001_a.up.sql"}, wantErr: "needs both an up and a down file"},
+		{name: "missing up file", files: []string{"0001_a.down.sql"}, wantErr: "needs both an up and a down file"},
+		{name: "two names for a version", files: []string{"0001_a.up.sql", "0001_a.down.sql", "0001_b.up.sql", "0001_b.down.sql"}, wantErr: `has two names, "a" and "b"`},
+		{name: "same version written twice", files: []string{"1_a.up.sql", "1_a.down.sql", "0001_a.up.sql"}, wantErr: "has two up files"},
+		{name: "invalid file name", files: []string{"create_table.sql"}, wantErr: "invalid migration file name"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fsys := fstest.MapFS{}
+			for _, name := range tt.files {
+				fsys["migrations/"+name] = &fstest.MapFile{Data: []byte("SELECT 1")}
+			}
+
+			_, err := loadMigrations(fsys, "migrations")
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("error = %v, want one containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestEmbeddedMigrationsLoad(t *testing.T) {
+	migrations, err := loadMigrations(migrationFiles, "migrations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, migration := range migrations {
+		if migration.Version != i+1 {
+			t.Errorf("migration %d_%s has version %d, want %d", migration.Version, migration.Name, migration.Version, i+1)
+		}
+	}
+}
+
+// testMigrator returns a Migrator for migrations with the given versions
+func testMigrator(versions ...int) *Migrator {
+	m := &Migrator{}
+	for _, version := range versions {
+		m.migrations = append(m.migrations, Migration{Version: version})
+	}
+	return m
+}
+
+// planVersions returns the versions plan runs and their direction
+func planVersions(m *Migrator, current int, want int) ([]int, string) {
+	migrations, direction := m.plan(current, want)
+	var versions []int
+	for _, migration := range migrations {
+		versions = append(versions, migration.Version)
+	}
+	return versions, direction
+}
+
+func TestMigrationPlan(t *testing.T) {
+	m := testMigrator(1, 2, 5, 7)
+
+	tests := []struct {
+		name          string
+		current       int
+		want          int
+		wantVersions  []int
+		wantDirection string
+	}{
+		{name: "up from empty", current: 0, want: 7, wantVersions: []int{1, 2, 5, 7}, wantDirection: "up"},
+		{name: "up to a version", current: 1, want: 5, wantVersions: []int{2, 5}, wantDirection: "up"},
+		{name: "down to a version", current: 7, want: 2, wantVersions: []int{7, 5}, wantDirection: "down"},
+		{name: "to 0 reverts everything", current: 7, want: 0, wantVersions: []int{7, 5, 2, 1}, wantDirection: "down"},
+		{name: "up to date", current: 5, want: 5, wantDirection: "up"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			versions, direction := planVersions(m, tt.current, tt.want)
+			if !slices.Equal(versions, tt.wantVersions) || direction != tt.wantDirection {
+				t.Errorf("plan(%d, %d) = %v %s, want %v %s", tt.current, tt.want, versions, direction, tt.wantVersions, tt.wantDirection)
+			}
+		})
+	}
+}
+
+func TestMigratorPreviousVersion(t *testing.T) {
+	m := testMigrator(1, 2, 5, 7)
+
+	tests := []struct {
+		current int
+		want    int
+	}{
+		{current: 7, want: 5},
+		{current: 5, want: 2},
+		{current: 1, want: 0},
+		{current: 0, want: 0},
+		// A schema at a version this binary does not know reverts to the newest it does
+		{current: 6, want: 5},
+	}
+	for _, tt := range tests {
+		if got := m.previous(tt.current); got != tt.want {
+			t.Errorf("previous(%d) = %d, want %d", tt.current, got, tt.want)
+		}
+	}
+}
+
+func TestMigratorToRejectsUnknownVersions(t *testing.T) {
+	m := testMigrator(1, 2, 5)
+
+	// The version is checked before the database is used
+	if err := m.To(context.Background(), 3); err == nil || !strings.Contains(err.Error(), "unknown migration version 3") {
+		t.Errorf("To(3) error = %v, want unknown migration version", err)
+	}
+	if got := m.Latest(); got != 5 {
+		t.Errorf("Latest() = %d, want 5", got)
+	}
+}
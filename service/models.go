@@ -4,27 +4,61 @@ import (
 	"time"
 )
 
-// CreateCoffeeOrder
+// CreateCoffeeOrder is the request body of the order endpoints. The coffee
+// type must also be in the coffee_types catalog.
 type CreateCoffeeOrder struct {
-	UserName   string `json:"user_name"`
-	CoffeeType string `json:"coffee_type"`
+	UserName   string `json:"user_name" validate:"required,max=100,charset=name"`
+	CoffeeType string `json:"coffee_type" validate:"required,max=50,charset=slug"`
 }
 
 // CoffeeOrder model
 type CoffeeOrder struct {
-	ID         int       `json:"id"`
-	UserName   string    `json:"user_name"`
-	CoffeeType string    `json:"coffee_type"`
-	CreatedAt  time.Time `json:"created_at"`
+	ID         int         `json:"id"`
+	UserName   string      `json:"user_name"`
+	CoffeeType string      `json:"coffee_type"`
+	Status     OrderStatus `json:"status"`
+	Version    int         `json:"version"`
+	CreatedAt  time.Time   `json:"created_at"`
 }
 
+// UpdateCoffeeOrder is the request body of PATCH /coffee/{id}
+type UpdateCoffeeOrder struct {
+	Status OrderStatus `json:"status"`
+}
+
+// HealthResponse is the aggregated result of the health checks
 type HealthResponse struct {
+	Status    string              `json:"status"`
+	Timestamp time.Time           `json:"timestamp"`
+	Checks    []HealthCheckResult `json:"checks,omitempty"`
+}
+
+// HealthCheckResult is the result of a single health check
+type HealthCheckResult struct {
+	Name      string    `json:"name"`
 	Status    string    `json:"status"`
-	Timestamp time.Time `json:"timestamp"`
-	Database  string    `json:"database"`
+	Critical  bool      `json:"critical"`
+	Error     string    `json:"error,omitempty"`
+	Duration  string    `json:"duration"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+// ProblemDetails is an RFC 7807 error response, extended with the error type
+// and the IDs that find the request in the logs and traces
+type ProblemDetails struct {
+	Type      string `json:"type"`
+	Title     string `json:"title"`
+	Status    int    `json:"status"`
+	Detail    string `json:"detail,omitempty"`
+	Instance  string `json:"instance,omitempty"`
+	ErrorType string `json:"error_type"`
+	RequestID string `json:"request_id,omitempty"`
+	TraceID   string `json:"trace_id,omitempty"`
+	// Errors lists the invalid fields of a validation error
+	Errors []FieldError `json:"errors,omitempty"`
 }
 
-// ErrorResponse represents an error response
-type ErrorResponse struct {
-	Error string `json:"error"`
+// LogLevelRequest reads or changes the global log level
+type LogLevelRequest struct {
+	Level string `json:"level"`
 }
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+)
+
+// OrderStatus is the state of a coffee order
+type OrderStatus string
+
+const (
+	StatusPlaced    OrderStatus = "placed"
+	StatusBrewing   OrderStatus = "brewing"
+	StatusReady     OrderStatus = "ready"
+	StatusPickedUp  OrderStatus = "picked_up"
+	StatusCancelled OrderStatus = "cancelled"
+)
+
+// orderTransitions lists the states each state can move to. An order moves
+// forward one step at a time and can be cancelled until it is picked up;
+// picked up and cancelled orders are final.
+var orderTransitions = map[OrderStatus][]OrderStatus{
+	StatusPlaced:  {StatusBrewing, StatusCancelled},
+	StatusBrewing: {StatusReady, StatusCancelled},
+	StatusReady:   {StatusPickedUp, StatusCancelled},
+}
+
+// Valid reports whether s is a known state
+func (s OrderStatus) Valid() bool {
+	switch s {
+	case StatusPlaced, StatusBrewing, StatusReady, StatusPickedUp, StatusCancelled:
+		return true
+	}
+	return false
+}
+
+// checkTransition returns a conflict error if an order cannot move from one state to the other
+func checkTransition(id int, from OrderStatus, to OrderStatus) error {
+	for _, next := range orderTransitions[from] {
+		if next == to {
+			return nil
+		}
+	}
+	return ConflictError(fmt.Errorf("coffee order %d cannot change from %s to %s", id, from, to))
+}
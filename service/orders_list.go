@@ -0,0 +1,191 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Page sizes of GET /coffee
+const (
+	defaultListLimit = 20
+	maxListLimit     = 100
+)
+
+// OrderCursor is the position of the last order of a page. The next page
+// starts after it in the (created_at, id) order. A cursor only continues the
+// listing it was issued for, with the same sort direction and filters.
+type OrderCursor struct {
+	CreatedAt time.Time
+	ID        int
+	// Descending and Filters are the sort direction and filterHash of the listing
+	Descending bool
+	Filters    string
+}
+
+// ListCoffeeOrdersQuery filters, sorts and pages coffee orders. Empty filters
+// match every order.
+type ListCoffeeOrdersQuery struct {
+	UserName      string
+	CoffeeType    string
+	CreatedAfter  *time.Time
+	CreatedBefore *time.Time
+	// Descending lists the newest orders first
+	Descending bool
+	Limit      int
+	// After continues the listing after the cursor of the previous page
+	After *OrderCursor
+}
+
+// CoffeeOrderPage is one page of listed orders. NextCursor is empty on the last page.
+type CoffeeOrderPage struct {
+	Orders     []CoffeeOrder `json:"orders"`
+	NextCursor string        `json:"next_cursor,omitempty"`
+}
+
+// Encode returns the opaque cursor string sent to clients
+func (c OrderCursor) Encode() string {
+	sort := "asc"
+	if c.Descending {
+		sort = "desc"
+	}
+	raw := strings.Join([]string{c.CreatedAt.UTC().Format(time.RFC3339Nano), strconv.Itoa(c.ID), sort, c.Filters}, "|")
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+// filterHash identifies the filters of q, so a cursor can be checked against
+// the listing it continues
+func (q ListCoffeeOrdersQuery) filterHash() string {
+	formatTime := func(t *time.Time) string {
+		if t == nil {
+			return ""
+		}
+		return t.Format(time.RFC3339Nano)
+	}
+
+	hash := sha256.New()
+	for _, filter := range []string{q.UserName, q.CoffeeType, formatTime(q.CreatedAfter), formatTime(q.CreatedBefore)} {
+		hash.Write([]byte(lengthPrefixed(filter)))
+	}
+	return hex.EncodeToString(hash.Sum(nil))[:16]
+}
+
+// decodeOrderCursor parses a cursor created by OrderCursor.Encode
+func decodeOrderCursor(cursor string) (*OrderCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, errors.New("malformed cursor")
+	}
+	parts := strings.Split(string(raw), "|")
+	if len(parts) != 4 || (parts[2] != "asc" && parts[2] != "desc") {
+		return nil, errors.New("malformed cursor")
+	}
+	createdAt, err := time.Parse(time.RFC3339Nano, parts[0])
+	if err != nil {
+		return nil, errors.New("malformed cursor")
+	}
+	id, err := parseOrderID(parts[1])
+	if err != nil {
+		return nil, errors.New("malformed cursor")
+	}
+	return &OrderCursor{CreatedAt: createdAt, ID: id, Descending: parts[2] == "desc", Filters: parts[3]}, nil
+}
+
+// parseListCoffeeOrdersQuery reads the query parameters of GET /coffee:
+//
+//	user_name, coffee_type           exact match filters
+//	created_after, created_before    RFC 3339 bounds of created_at, inclusive and exclusive
+//	sort                             created_at (oldest first) or -created_at (newest first, default)
+//	limit                            page size, 1 to 100, default 20
+//	cursor                           next_cursor of the previous page
+//
+// Invalid parameters are reported as field errors.
+func parseListCoffeeOrdersQuery(values url.Values) (ListCoffeeOrdersQuery, error) {
+	query := ListCoffeeOrdersQuery{
+		UserName:   values.Get("user_name"),
+		CoffeeType: strings.ToLower(values.Get("coffee_type")),
+		Descending: true,
+		Limit:      defaultListLimit,
+	}
+
+	var errs ValidationErrors
+	invalid := func(field string, message string) {
+		errs = append(errs, FieldError{Field: field, Code: "invalid", Message: message})
+	}
+
+	parseTime := func(field string) *time.Time {
+		value := values.Get(field)
+		if value == "" {
+			return nil
+		}
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			invalid(field, "must be an RFC 3339 timestamp, e.g. 2024-01-02T15:04:05Z")
+			return nil
+		}
+		t = t.UTC()
+		return &t
+	}
+	query.CreatedAfter = parseTime("created_after")
+	query.CreatedBefore = parseTime("created_before")
+
+	switch values.Get("sort") {
+	case "", "-created_at":
+	case "created_at":
+		query.Descending = false
+	default:
+		invalid("sort", "must be created_at or -created_at")
+	}
+
+	if limit := values.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 || n > maxListLimit {
+			invalid("limit", fmt.Sprintf("must be a number from 1 to %d", maxListLimit))
+		} else {
+			query.Limit = n
+		}
+	}
+
+	if cursor := values.Get("cursor"); cursor != "" {
+		after, err := decodeOrderCursor(cursor)
+		switch {
+		case err != nil:
+			invalid("cursor", err.Error())
+		case after.Descending != query.Descending || after.Filters != query.filterHash():
+			invalid("cursor", "was issued for a different sort or filters")
+		default:
+			query.After = after
+		}
+	}
+
+	if len(errs) > 0 {
+		return query, ValidationError(errs)
+	}
+	return query, nil
+}
+
+// newCoffeeOrderPage builds a page from up to query.Limit+1 listed orders. The
+// extra order only tells that there is a next page and is not returned.
+func newCoffeeOrderPage(orders []CoffeeOrder, query ListCoffeeOrdersQuery) *CoffeeOrderPage {
+	page := &CoffeeOrderPage{Orders: orders}
+	if len(orders) > query.Limit {
+		page.Orders = orders[:query.Limit]
+		last := page.Orders[query.Limit-1]
+		page.NextCursor = OrderCursor{
+			CreatedAt:  last.CreatedAt,
+			ID:         last.ID,
+			Descending: query.Descending,
+			Filters:    query.filterHash(),
+		}.Encode()
+	}
+	if page.Orders == nil {
+		page.Orders = []CoffeeOrder{}
+	}
+	return page
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// requestLimits bounds the size of request bodies and the number of requests
+// served at the same time
+type requestLimits struct {
+	maxBodyBytes int64
+	// slots holds one token per request in flight; nil disables the limit
+	slots      chan struct{}
+	retryAfter time.Duration
+}
+
+// newRequestLimits creates the limits. maxInFlight 0 disables load shedding.
+func newRequestLimits(maxBodyBytes int64, maxInFlight int, retryAfter time.Duration) *requestLimits {
+	limits := &requestLimits{
+		maxBodyBytes: maxBodyBytes,
+		retryAfter:   retryAfter,
+	}
+	if maxInFlight > 0 {
+		limits.slots = make(chan struct{}, maxInFlight)
+	}
+	return limits
+}
+
+// acquire takes an in-flight slot, reporting false if all are taken
+func (l *requestLimits) acquire() bool {
+	if l.slots == nil {
+		return true
+	}
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (l *requestLimits) release() {
+	if l.slots != nil {
+		<-l.slots
+	}
+}
+
+// loadSheddingMiddleware responds 503 with Retry-After instead of queueing
+// once the in-flight limit is reached. It is mounted on the application routes
+// only, so health probes and metrics scrapes are never shed.
+func (app *App) loadSheddingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !app.limits.acquire() {
+			ctx := r.Context()
+			span := trace.SpanFromContext(ctx)
+			span.SetAttributes(attribute.Bool("http.request.shed", true))
+			span.AddEvent("request shed", trace.WithAttributes(
+				attribute.Int("http.server.max_in_flight", cap(app.limits.slots)),
+			))
+			app.logger.WarnContext(ctx, "Request shed, too many requests in flight", "max_in_flight", cap(app.limits.slots))
+			app.metrics.sendRejectedRequestMetrics(ctx, resolveRoutePattern(r), KindOverloaded)
+
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(app.limits.retryAfter.Seconds()))))
+			writeProblem(w, r, KindOverloaded, "Server is overloaded, retry later")
+			return
+		}
+		defer app.limits.release()
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// bodyLimitMiddleware caps the request body before any handler decodes it.
+// Bodies that declare a larger Content-Length are rejected up front; the others
+// fail with *http.MaxBytesError once the limit is read past.
+func (app *App) bodyLimitMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength > app.limits.maxBodyBytes {
+			app.rejectBodyTooLarge(w, r)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, app.limits.maxBodyBytes)
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// rejectBodyTooLarge responds 413 and records the rejection on the span and in metrics
+func (app *App) rejectBodyTooLarge(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	span := trace.SpanFromContext(ctx)
+	span.AddEvent("request body too large", trace.WithAttributes(
+		attribute.Int64("http.request.max_body_size", app.limits.maxBodyBytes),
+	))
+	app.logger.WarnContext(ctx, "Request body too large", "max_body_bytes", app.limits.maxBodyBytes)
+	app.metrics.sendRejectedRequestMetrics(ctx, resolveRoutePattern(r), KindBodyTooLarge)
+
+	writeProblem(w, r, KindBodyTooLarge, "Request body too large")
+}
+
+// resolveRoutePattern returns the route pattern r matches, e.g. "/coffee/{id}",
+// or "" if it matches none. Requests can be rejected before chi has matched
+// the whole route, so the pattern is looked up in the router instead of read
+// from the route context.
+func resolveRoutePattern(r *http.Request) string {
+	routeContext := chi.RouteContext(r.Context())
+	if routeContext == nil || routeContext.Routes == nil {
+		return ""
+	}
+
+	resolved := chi.NewRouteContext()
+	if !routeContext.Routes.Match(resolved, r.Method, r.URL.Path) {
+		return ""
+	}
+	return resolved.RoutePattern()
+}
+
+// isBodyTooLarge reports whether err comes from reading past the body limit
+func isBodyTooLarge(err error) bool {
+	var maxBytesErr *http.MaxBytesError
+	return errors.As(err, &maxBytesErr)
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRejectedRequestsRecordTheRoute(t *testing.T) {
+	tests := []struct {
+		name       string
+		maxBody    int64
+		maxFlight  int
+		method     string
+		path       string
+		endpoint   string
+		wantStatus int
+		wantReason ErrorKind
+	}{
+		{name: "body too large", maxBody: 4, method: http.MethodPatch, path: "/coffee/1", endpoint: "/coffee/{id}", wantStatus: http.StatusRequestEntityTooLarge, wantReason: KindBodyTooLarge},
+		{name: "overloaded", maxBody: 1 << 20, maxFlight: 1, method: http.MethodPost, path: "/make-coffee-tom", endpoint: "/make-coffee-tom", wantStatus: http.StatusServiceUnavailable, wantReason: KindOverloaded},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t)
+			app.limits = newRequestLimits(tt.maxBody, tt.maxFlight, 0)
+			// Take the only in-flight slot, so the request is shed
+			if tt.maxFlight > 0 {
+				app.limits.acquire()
+			}
+
+			w := app.serve(httptest.NewRequest(tt.method, tt.path, strings.NewReader(`{"status": "brewing"}`)))
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+
+			dims := []Dimension{{Name: "Endpoint", Value: tt.endpoint}, {Name: "Reason", Value: string(tt.wantReason)}}
+			if got := app.recorder.Sum("RequestsRejected_ByReason", dims...); got != 1 {
+				t.Errorf("RequestsRejected_ByReason%v = %g, want 1: %+v", dims, got, app.recorder.Find("RequestsRejected_ByReason"))
+			}
+			if got := app.recorder.Sum("RequestsRejected_Total"); got != 1 {
+				t.Errorf("RequestsRejected_Total = %g, want 1", got)
+			}
+			errorType := Dimension{Name: "ErrorType", Value: string(tt.wantReason)}
+			if got := app.recorder.Sum("RequestErrors_ByType", errorType); got != 1 {
+				t.Errorf("RequestErrors_ByType{%s} = %g, want 1", tt.wantReason, got)
+			}
+		})
+	}
+}
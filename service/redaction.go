@@ -0,0 +1,201 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// RedactionPolicy is how a Redactor treats sensitive values
+type RedactionPolicy string
+
+const (
+	RedactNone RedactionPolicy = "none"
+	RedactDrop RedactionPolicy = "drop"
+	RedactHash RedactionPolicy = "hash"
+	RedactMask RedactionPolicy = "mask"
+)
+
+// Redactor applies one redaction policy to sensitive values wherever they
+// leave the service: log attributes, span attributes and metric dimensions.
+// Keys are matched ignoring case and "_", "." and "-" separators, so
+// "user_name", "UserName" and "user.name" are all the same key. With the hash
+// policy the same value always becomes the same token, so redacted users can
+// still be correlated across logs, traces and metrics.
+type Redactor struct {
+	policy RedactionPolicy
+	salt   []byte
+	keys   map[string]bool
+}
+
+// NewRedactor creates a Redactor for the given sensitive keys. salt is the
+// HMAC key of the hash policy.
+func NewRedactor(policy RedactionPolicy, salt string, keys []string) (*Redactor, error) {
+	switch policy {
+	case RedactNone, RedactDrop, RedactHash, RedactMask:
+	default:
+		return nil, fmt.Errorf("unknown redaction policy %q", policy)
+	}
+
+	r := &Redactor{
+		policy: policy,
+		salt:   []byte(salt),
+		keys:   make(map[string]bool, len(keys)),
+	}
+	for _, key := range keys {
+		r.keys[normalizeKey(key)] = true
+	}
+	return r, nil
+}
+
+// Sensitive reports whether values under key are redacted
+func (r *Redactor) Sensitive(key string) bool {
+	return r.policy != RedactNone && r.keys[normalizeKey(key)]
+}
+
+// Redact returns the redacted form of value, or false if the policy drops it
+func (r *Redactor) Redact(value string) (string, bool) {
+	switch r.policy {
+	case RedactDrop:
+		return "", false
+	case RedactHash:
+		mac := hmac.New(sha256.New, r.salt)
+		mac.Write([]byte(value))
+		return "h_" + hex.EncodeToString(mac.Sum(nil))[:16], true
+	case RedactMask:
+		if value == "" {
+			return "", true
+		}
+		return string([]rune(value)[:1]) + "***", true
+	default:
+		return value, true
+	}
+}
+
+// RedactAttr redacts a log attribute, descending into groups. The second
+// result is false if the attribute is dropped.
+func (r *Redactor) RedactAttr(attr slog.Attr) (slog.Attr, bool) {
+	if attr.Value.Kind() == slog.KindGroup {
+		attrs := r.RedactAttrs(attr.Value.Group())
+		return slog.Attr{Key: attr.Key, Value: slog.GroupValue(attrs...)}, true
+	}
+	if !r.Sensitive(attr.Key) {
+		return attr, true
+	}
+
+	value, ok := r.Redact(attr.Value.String())
+	return slog.String(attr.Key, value), ok
+}
+
+// RedactAttrs redacts a list of log attributes
+func (r *Redactor) RedactAttrs(attrs []slog.Attr) []slog.Attr {
+	redacted := make([]slog.Attr, 0, len(attrs))
+	for _, attr := range attrs {
+		if attr, ok := r.RedactAttr(attr); ok {
+			redacted = append(redacted, attr)
+		}
+	}
+	return redacted
+}
+
+// RedactKeyValues redacts a list of span attributes. Log records added to
+// spans as events have their group members flattened into dotted keys such as
+// "order.user_name", so the last part of a key is checked as well, as the
+// member itself is in logs.
+func (r *Redactor) RedactKeyValues(attrs []attribute.KeyValue) []attribute.KeyValue {
+	redacted := make([]attribute.KeyValue, 0, len(attrs))
+	for _, attr := range attrs {
+		key := string(attr.Key)
+		if !r.Sensitive(key) && !r.Sensitive(key[strings.LastIndex(key, ".")+1:]) {
+			redacted = append(redacted, attr)
+			continue
+		}
+		if value, ok := r.Redact(attr.Value.Emit()); ok {
+			redacted = append(redacted, attr.Key.String(value))
+		}
+	}
+	return redacted
+}
+
+// RedactQuery redacts the sensitive parameters of a URL query string, such as
+// the user_name filter of GET /coffee. A query that cannot be parsed is
+// replaced, since it may still hold sensitive values.
+func (r *Redactor) RedactQuery(rawQuery string) string {
+	values, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return "(unparsable query)"
+	}
+
+	changed := false
+	for key, list := range values {
+		if !r.Sensitive(key) {
+			continue
+		}
+		changed = true
+		redacted := list[:0]
+		for _, value := range list {
+			if value, ok := r.Redact(value); ok {
+				redacted = append(redacted, value)
+			}
+		}
+		if len(redacted) == 0 {
+			delete(values, key)
+		} else {
+			values[key] = redacted
+		}
+	}
+
+	if !changed {
+		return rawQuery
+	}
+	return values.Encode()
+}
+
+// normalizeKey lowercases key and strips separators
+func normalizeKey(key string) string {
+	return strings.NewReplacer("_", "", ".", "", "-", "").Replace(strings.ToLower(key))
+}
+
+// redactingSpanProcessor redacts span and span event attributes before the
+// span reaches the exporting processor. Attributes can be set at any time
+// during the span, so redaction happens when the span ends.
+type redactingSpanProcessor struct {
+	sdktrace.SpanProcessor
+	redactor *Redactor
+}
+
+// newRedactingSpanProcessor wraps next, usually the batch span processor
+func newRedactingSpanProcessor(next sdktrace.SpanProcessor, redactor *Redactor) sdktrace.SpanProcessor {
+	return &redactingSpanProcessor{SpanProcessor: next, redactor: redactor}
+}
+
+func (p *redactingSpanProcessor) OnEnd(s sdktrace.ReadOnlySpan) {
+	p.SpanProcessor.OnEnd(&redactedSpan{ReadOnlySpan: s, redactor: p.redactor})
+}
+
+// redactedSpan is a read-only span whose attributes are redacted on access
+type redactedSpan struct {
+	sdktrace.ReadOnlySpan
+	redactor *Redactor
+}
+
+func (s *redactedSpan) Attributes() []attribute.KeyValue {
+	return s.redactor.RedactKeyValues(s.ReadOnlySpan.Attributes())
+}
+
+func (s *redactedSpan) Events() []sdktrace.Event {
+	events := s.ReadOnlySpan.Events()
+	redacted := make([]sdktrace.Event, len(events))
+	for i, event := range events {
+		event.Attributes = s.redactor.RedactKeyValues(event.Attributes)
+		redacted[i] = event
+	}
+	return redacted
+}
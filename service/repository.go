@@ -0,0 +1,29 @@
+package main
+
+import (
+	"context"
+)
+
+// OrderRepository stores coffee orders and the coffee type catalog. Handlers
+// only reach the data through it, so the HTTP layer can run against
+// MemoryOrderRepository instead of PostgreSQL.
+type OrderRepository interface {
+	// GetCoffeeOrder returns the order with id, or a not found error
+	GetCoffeeOrder(ctx context.Context, id int) (*CoffeeOrder, error)
+	// CreateCoffeeOrder saves a new order created now
+	CreateCoffeeOrder(ctx context.Context, order CreateCoffeeOrder) (*CoffeeOrder, error)
+	// CreateCoffeeOrderInOneHour saves a new order with a creation time in the future
+	CreateCoffeeOrderInOneHour(ctx context.Context, order CreateCoffeeOrder) (*CoffeeOrder, error)
+	// UpdateCoffeeOrderStatus moves an order to a new state and increments its
+	// version, returning the updated order and the state it left. It returns a
+	// precondition failed error if the current version does not meet ifMatch,
+	// and a conflict error if the transition is not allowed.
+	UpdateCoffeeOrderStatus(ctx context.Context, id int, to OrderStatus, ifMatch IfMatch) (*CoffeeOrder, OrderStatus, error)
+	// ListCoffeeOrders returns one page of the orders matching query
+	ListCoffeeOrders(ctx context.Context, query ListCoffeeOrdersQuery) (*CoffeeOrderPage, error)
+	// CoffeeTypeExists reports whether name is an active coffee type in the catalog
+	CoffeeTypeExists(ctx context.Context, name string) (bool, error)
+}
+
+// Database is the PostgreSQL OrderRepository
+var _ OrderRepository = (*Database)(nil)
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryOrderRepository is an OrderRepository that keeps orders in memory,
+// with the same IDs, timestamps and errors as the PostgreSQL one. It is meant
+// for tests of the HTTP layer that run without PostgreSQL.
+type MemoryOrderRepository struct {
+	mu          sync.Mutex
+	orders      map[int]CoffeeOrder
+	nextID      int
+	coffeeTypes map[string]bool
+}
+
+// NewMemoryOrderRepository creates an empty MemoryOrderRepository whose
+// catalog holds the coffee types seeded by migration 0002
+func NewMemoryOrderRepository() *MemoryOrderRepository {
+	coffeeTypes := make(map[string]bool)
+	for _, name := range []string{"espresso", "doppio", "americano", "cappuccino", "latte", "flat_white", "cortado", "macchiato", "mocha"} {
+		coffeeTypes[name] = true
+	}
+
+	return &MemoryOrderRepository{
+		orders:      make(map[int]CoffeeOrder),
+		nextID:      1,
+		coffeeTypes: coffeeTypes,
+	}
+}
+
+// GetCoffeeOrder returns a copy of the order with id
+func (m *MemoryOrderRepository) GetCoffeeOrder(ctx context.Context, id int) (*CoffeeOrder, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	order, ok := m.orders[id]
+	if !ok {
+		return nil, NotFoundError(fmt.Errorf("coffee order %d not found", id))
+	}
+	return &order, nil
+}
+
+// CreateCoffeeOrder saves a new order created now
+func (m *MemoryOrderRepository) CreateCoffeeOrder(ctx context.Context, order CreateCoffeeOrder) (*CoffeeOrder, error) {
+	return m.create(order, time.Now())
+}
+
+// CreateCoffeeOrderInOneHour saves a new order with the same future creation time as the PostgreSQL repository
+func (m *MemoryOrderRepository) CreateCoffeeOrderInOneHour(ctx context.Context, order CreateCoffeeOrder) (*CoffeeOrder, error) {
+	return m.create(order, time.Now().Add(2*time.Hour))
+}
+
+// UpdateCoffeeOrderStatus moves an order to a new state
+func (m *MemoryOrderRepository) UpdateCoffeeOrderStatus(ctx context.Context, id int, to OrderStatus, ifMatch IfMatch) (*CoffeeOrder, OrderStatus, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	order, ok := m.orders[id]
+	if !ok {
+		return nil, "", NotFoundError(fmt.Errorf("coffee order %d not found", id))
+	}
+
+	if err := checkVersion(id, order.Version, ifMatch); err != nil {
+		return nil, "", err
+	}
+	from := order.Status
+	if err := checkTransition(id, from, to); err != nil {
+		return nil, "", err
+	}
+
+	order.Status = to
+	order.Version++
+	m.orders[id] = order
+	return &order, from, nil
+}
+
+// ListCoffeeOrders returns one page of the orders matching query, in the same
+// (created_at, id) order as the PostgreSQL repository
+func (m *MemoryOrderRepository) ListCoffeeOrders(ctx context.Context, query ListCoffeeOrdersQuery) (*CoffeeOrderPage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// before reports whether a comes before b in ascending (created_at, id) order
+	before := func(a, b OrderCursor) bool {
+		if !a.CreatedAt.Equal(b.CreatedAt) {
+			return a.CreatedAt.Before(b.CreatedAt)
+		}
+		return a.ID < b.ID
+	}
+	less := func(a, b OrderCursor) bool {
+		if query.Descending {
+			return before(b, a)
+		}
+		return before(a, b)
+	}
+
+	var orders []CoffeeOrder
+	for _, order := range m.orders {
+		key := OrderCursor{CreatedAt: order.CreatedAt, ID: order.ID}
+		switch {
+		case query.UserName != "" && order.UserName != query.UserName,
+			query.CoffeeType != "" && order.CoffeeType != query.CoffeeType,
+			query.CreatedAfter != nil && order.CreatedAt.Before(*query.CreatedAfter),
+			query.CreatedBefore != nil && !order.CreatedAt.Before(*query.CreatedBefore),
+			query.After != nil && !less(*query.After, key):
+			continue
+		}
+		orders = append(orders, order)
+	}
+
+	sort.Slice(orders, func(i, j int) bool {
+		return less(OrderCursor{CreatedAt: orders[i].CreatedAt, ID: orders[i].ID}, OrderCursor{CreatedAt: orders[j].CreatedAt, ID: orders[j].ID})
+	})
+	if len(orders) > query.Limit+1 {
+		orders = orders[:query.Limit+1]
+	}
+
+	return newCoffeeOrderPage(orders, query), nil
+}
+
+// CoffeeTypeExists reports whether name is in the catalog
+func (m *MemoryOrderRepository) CoffeeTypeExists(ctx context.Context, name string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.coffeeTypes[name], nil
+}
+
+func (m *MemoryOrderRepository) create(order CreateCoffeeOrder, createdAt time.Time) (*CoffeeOrder, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	created := CoffeeOrder{
+		ID:         m.nextID,
+		UserName:   order.UserName,
+		CoffeeType: order.CoffeeType,
+		Status:     StatusPlaced,
+		Version:    1,
+		CreatedAt:  createdAt,
+	}
+	m.orders[created.ID] = created
+	m.nextID++
+	return &created, nil
+}
@@ -1,36 +1,88 @@
 package main
 
 import (
+	"net/http"
+	"strings"
+
 	"github.com/go-chi/chi/v5"
-	"github.com/go-chi/chi/v5/middleware"
 )
 
 func setupRoutes(app *App) *chi.Mux {
 	router := chi.NewRouter()
 
-	// Middleware
-	router.Use(middleware.RequestID)
-	router.Use(middleware.Recoverer)
-	router.Use(app.tracingMiddleware)
-	router.Use(app.loggingMiddleware)
-	router.Use(app.metricsMiddleware)
-	router.Use(app.responseHeadersMiddleware)
+	// Middleware; observabilityMiddleware also recovers panics
+	router.Use(app.observabilityMiddleware)
+	router.Use(app.bodyLimitMiddleware)
+
+	// Unmatched requests get problem responses like every other error. Groups
+	// and subrouters copy these handlers when they are created, so they are
+	// set before any route.
+	router.NotFound(notFoundHandler)
+	router.MethodNotAllowed(methodNotAllowedHandler)
 
 	// Routes
-	router.Get("/health", app.healthHandler)
+	// Health probes; /health is kept for existing load balancer and Docker configurations
+	router.Get("/livez", app.livenessHandler)
+	router.Get("/readyz", app.readinessHandler)
+	router.Get("/startupz", app.startupHandler)
+	router.Get("/health", app.readinessHandler)
+
+	// Admin and debug endpoints are only served to trusted callers
+	router.Group(func(router chi.Router) {
+		router.Use(app.adminMiddleware)
 
-	// Standard coffee routes
-	router.Route("/coffee", func(r chi.Router) {
-		r.Get("/{id}", app.getCoffeeOrderHandler)
+		router.Get("/admin/log-level", app.getLogLevelHandler)
+		router.Put("/admin/log-level", app.setLogLevelHandler)
+		router.Get("/debug/pool", app.poolStatsHandler)
 	})
 
-	// Person-specific coffee order endpoints
-	router.Post("/make-coffee-tom", app.createCoffeeOrderTomHandler)
-	router.Post("/make-coffee-honza", app.createCoffeeOrderHonzaHandler)
-	router.Post("/make-coffee-marek", app.createCoffeeOrderMarekHandler)
-	router.Post("/make-coffee-jakub", app.createCoffeeOrderJakubHandler)
-	router.Post("/make-coffee-matus", app.createCoffeeOrderMatusHandler)
-	router.Post("/make-coffee-mila", app.createCoffeeOrderMilaHandler)
+	// Pull-based backends such as Prometheus expose their own endpoint
+	if handler, ok := app.metrics.recorder.(http.Handler); ok {
+		router.Handle("/metrics", handler)
+	}
+
+	// Application routes shed load when too many requests are in flight
+	router.Group(func(router chi.Router) {
+		router.Use(app.loadSheddingMiddleware)
+
+		// Standard coffee routes
+		router.Route("/coffee", func(r chi.Router) {
+			r.Get("/", app.listCoffeeOrdersHandler)
+			r.Get("/{id}", app.getCoffeeOrderHandler)
+			r.Patch("/{id}", app.updateCoffeeOrderHandler)
+			r.Post("/{id}/cancel", app.cancelCoffeeOrderHandler)
+		})
+
+		// Person-specific coffee order endpoints
+		router.Post("/make-coffee-tom", app.createCoffeeOrderTomHandler)
+		router.Post("/make-coffee-honza", app.createCoffeeOrderHonzaHandler)
+		router.Post("/make-coffee-marek", app.createCoffeeOrderMarekHandler)
+		router.Post("/make-coffee-jakub", app.createCoffeeOrderJakubHandler)
+		router.Post("/make-coffee-matus", app.createCoffeeOrderMatusHandler)
+		router.Post("/make-coffee-mila", app.createCoffeeOrderMilaHandler)
+	})
 
 	return router
 }
+
+// notFoundHandler responds to requests whose path matches no route
+func notFoundHandler(w http.ResponseWriter, r *http.Request) {
+	writeProblem(w, r, KindNotFound, "No route matches "+r.URL.Path)
+}
+
+// methodNotAllowedHandler responds to requests whose path matches a route that
+// does not accept the method. chi only lists the allowed methods in its own
+// handler, so they are looked up in the router again.
+func methodNotAllowedHandler(w http.ResponseWriter, r *http.Request) {
+	var allowed []string
+	if routeContext := chi.RouteContext(r.Context()); routeContext != nil && routeContext.Routes != nil {
+		for _, method := range []string{http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete} {
+			if routeContext.Routes.Match(chi.NewRouteContext(), method, r.URL.Path) {
+				allowed = append(allowed, method)
+			}
+		}
+	}
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+
+	writeProblem(w, r, KindMethodNotAllowed, r.Method+" is not allowed on "+r.URL.Path)
+}
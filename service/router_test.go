@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestUnmatchedRequestsGetProblems(t *testing.T) {
+	tests := []struct {
+		name       string
+		method     string
+		target     string
+		wantStatus int
+		wantKind   ErrorKind
+		wantAllow  string
+	}{
+		{name: "unknown path", method: http.MethodGet, target: "/wp-admin", wantStatus: http.StatusNotFound, wantKind: KindNotFound},
+		{name: "unknown method", method: http.MethodDelete, target: "/coffee/1", wantStatus: http.StatusMethodNotAllowed, wantKind: KindMethodNotAllowed, wantAllow: "GET, PATCH"},
+		{name: "unknown method on a top-level route", method: http.MethodGet, target: "/make-coffee-tom", wantStatus: http.StatusMethodNotAllowed, wantKind: KindMethodNotAllowed, wantAllow: "POST"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t)
+
+			w := app.serve(httptest.NewRequest(tt.method, tt.target, nil))
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if got := w.Header().Get("Content-Type"); got != "application/problem+json" {
+				t.Errorf("Content-Type = %q, want application/problem+json", got)
+			}
+			if got := w.Header().Get("Allow"); got != tt.wantAllow {
+				t.Errorf("Allow = %q, want %q", got, tt.wantAllow)
+			}
+
+			var problem ProblemDetails
+			if err := json.NewDecoder(w.Body).Decode(&problem); err != nil {
+				t.Fatal(err)
+			}
+			if problem.ErrorType != string(tt.wantKind) || problem.RequestID == "" {
+				t.Errorf("problem = %+v, want error_type %s and a request ID", problem, tt.wantKind)
+			}
+			if got := app.recorder.Sum("RequestErrors_ByType", Dimension{Name: "ErrorType", Value: string(tt.wantKind)}); got != 1 {
+				t.Errorf("RequestErrors_ByType{%s} = %g, want 1", tt.wantKind, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"math"
+	"runtime/metrics"
+	"sync"
+	"time"
+)
+
+// runtime/metrics samples read by the runtime collector
+const (
+	heapObjectsMetric = "/memory/classes/heap/objects:bytes"
+	heapUnusedMetric  = "/memory/classes/heap/unused:bytes"
+	heapAllocsMetric  = "/gc/heap/allocs:bytes"
+	gcCyclesMetric    = "/gc/cycles/total:gc-cycles"
+	gcPausesMetric    = "/gc/pauses:seconds"
+	goroutinesMetric  = "/sched/goroutines:goroutines"
+)
+
+// RuntimeStats is the Go runtime state over one collection interval
+type RuntimeStats struct {
+	HeapInUse  float64
+	AllocRate  float64
+	GCCycles   float64
+	GCPauseP50 float64
+	GCPauseP99 float64
+	GCPauseMax float64
+	Goroutines float64
+}
+
+// runtimeStatsCollector periodically reads runtime/metrics and publishes
+// RuntimeStats through Metrics. Cumulative runtime values are turned into
+// rates and per-interval quantiles by diffing against the previous read.
+type runtimeStatsCollector struct {
+	metrics  *Metrics
+	interval time.Duration
+	samples  []metrics.Sample
+
+	done      chan struct{}
+	stopped   chan struct{}
+	closeOnce sync.Once
+}
+
+// runtimeSnapshot holds the cumulative values of the previous read
+type runtimeSnapshot struct {
+	at          time.Time
+	allocs      uint64
+	gcCycles    uint64
+	pauseCounts []uint64
+}
+
+// startRuntimeStatsCollector publishes runtime statistics every interval
+// until the returned collector is closed
+func startRuntimeStatsCollector(m *Metrics, interval time.Duration) *runtimeStatsCollector {
+	c := &runtimeStatsCollector{
+		metrics:  m,
+		interval: interval,
+		samples: []metrics.Sample{
+			{Name: heapObjectsMetric},
+			{Name: heapUnusedMetric},
+			{Name: heapAllocsMetric},
+			{Name: gcCyclesMetric},
+			{Name: gcPausesMetric},
+			{Name: goroutinesMetric},
+		},
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go c.run()
+	return c
+}
+
+// Close stops the collector and waits for the background goroutine to exit
+func (c *runtimeStatsCollector) Close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		<-c.stopped
+	})
+}
+
+func (c *runtimeStatsCollector) run() {
+	defer close(c.stopped)
+
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+
+	_, previous := c.read(runtimeSnapshot{})
+	for {
+		select {
+		case <-ticker.C:
+			var stats RuntimeStats
+			stats, previous = c.read(previous)
+			c.metrics.sendRuntimeMetrics(context.Background(), stats)
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// read samples the runtime and returns the statistics since previous together
+// with the snapshot to diff the next read against
+func (c *runtimeStatsCollector) read(previous runtimeSnapshot) (RuntimeStats, runtimeSnapshot) {
+	metrics.Read(c.samples)
+	now := time.Now()
+
+	current := runtimeSnapshot{at: now}
+	var stats RuntimeStats
+	for _, sample := range c.samples {
+		switch sample.Name {
+		case heapObjectsMetric, heapUnusedMetric:
+			stats.HeapInUse += float64(sample.Value.Uint64())
+		case heapAllocsMetric:
+			current.allocs = sample.Value.Uint64()
+		case gcCyclesMetric:
+			current.gcCycles = sample.Value.Uint64()
+		case goroutinesMetric:
+			stats.Goroutines = float64(sample.Value.Uint64())
+		case gcPausesMetric:
+			histogram := sample.Value.Float64Histogram()
+			current.pauseCounts = append([]uint64(nil), histogram.Counts...)
+			pauses := subtractCounts(histogram.Counts, previous.pauseCounts)
+			stats.GCPauseP50 = histogramQuantile(pauses, histogram.Buckets, 0.5)
+			stats.GCPauseP99 = histogramQuantile(pauses, histogram.Buckets, 0.99)
+			stats.GCPauseMax = histogramQuantile(pauses, histogram.Buckets, 1)
+		}
+	}
+
+	if !previous.at.IsZero() {
+		elapsed := now.Sub(previous.at).Seconds()
+		stats.AllocRate = float64(current.allocs-previous.allocs) / elapsed
+		stats.GCCycles = float64(current.gcCycles - previous.gcCycles)
+	}
+	return stats, current
+}
+
+// subtractCounts returns the per-bucket counts of current that are not in previous
+func subtractCounts(current []uint64, previous []uint64) []uint64 {
+	delta := make([]uint64, len(current))
+	for i, count := range current {
+		delta[i] = count
+		if i < len(previous) {
+			delta[i] -= previous[i]
+		}
+	}
+	return delta
+}
+
+// histogramQuantile returns the upper bound of the bucket holding quantile q,
+// or 0 if the histogram is empty. buckets holds len(counts)+1 boundaries.
+func histogramQuantile(counts []uint64, buckets []float64, q float64) float64 {
+	var total uint64
+	for _, count := range counts {
+		total += count
+	}
+	if total == 0 {
+		return 0
+	}
+
+	rank := uint64(math.Ceil(q * float64(total)))
+	var cumulative uint64
+	for i, count := range counts {
+		cumulative += count
+		if cumulative >= rank {
+			// The last bucket is unbounded; report its lower bound instead
+			if math.IsInf(buckets[i+1], 1) {
+				return buckets[i]
+			}
+			return buckets[i+1]
+		}
+	}
+	return buckets[len(buckets)-1]
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// newSampler builds the trace sampler described by config. The per-route rules
+// are checked first; every other span is sampled by the OTEL_TRACES_SAMPLER
+// sampler, where the root sampler of the parentbased_* variants is capped at
+// config.TraceRateLimit traces per second.
+func newSampler(config *Config) (sdktrace.Sampler, error) {
+	var root sdktrace.Sampler
+	switch strings.TrimPrefix(config.TraceSampler, "parentbased_") {
+	case "always_on":
+		root = sdktrace.AlwaysSample()
+	case "always_off":
+		root = sdktrace.NeverSample()
+	case "traceidratio":
+		root = sdktrace.TraceIDRatioBased(config.TraceSamplerArg)
+	default:
+		return nil, fmt.Errorf("unknown trace sampler %q", config.TraceSampler)
+	}
+
+	if config.TraceRateLimit > 0 {
+		root = newRateLimitedSampler(root, config.TraceRateLimit)
+	}
+
+	sampler := root
+	if strings.HasPrefix(config.TraceSampler, "parentbased_") {
+		sampler = sdktrace.ParentBased(root)
+	}
+
+	return &routeSampler{
+		always:   config.TraceAlwaysSampleRoutes,
+		never:    config.TraceNeverSampleRoutes,
+		delegate: sampler,
+	}, nil
+}
+
+// routeSampler always or never samples server spans whose url.path matches a
+// route rule, and leaves all other spans to the delegate. A rule matches the
+// path exactly, or as a prefix when it ends in "*". Rules only decide for root
+// spans; a matching span with a parent follows the parent's sampled flag, so
+// a trace is never cut in half.
+type routeSampler struct {
+	always   []string
+	never    []string
+	delegate sdktrace.Sampler
+}
+
+func (s *routeSampler) ShouldSample(p sdktrace.SamplingParameters) sdktrace.SamplingResult {
+	path, ok := urlPath(p)
+	if !ok {
+		return s.delegate.ShouldSample(p)
+	}
+
+	var sample bool
+	switch {
+	case matchRoute(s.never, path):
+		sample = false
+	case matchRoute(s.always, path):
+		sample = true
+	default:
+		return s.delegate.ShouldSample(p)
+	}
+
+	parent := trace.SpanContextFromContext(p.ParentContext)
+	if parent.IsValid() {
+		sample = parent.IsSampled()
+	}
+	if sample {
+		return sdktrace.SamplingResult{Decision: sdktrace.RecordAndSample, Tracestate: parent.TraceState()}
+	}
+	return sdktrace.SamplingResult{Decision: sdktrace.Drop, Tracestate: parent.TraceState()}
+}
+
+func (s *routeSampler) Description() string {
+	return fmt.Sprintf("RouteSampler{always:%v,never:%v,%s}", s.always, s.never, s.delegate.Description())
+}
+
+// urlPath returns the url.path attribute the span was started with
+func urlPath(p sdktrace.SamplingParameters) (string, bool) {
+	for _, attr := range p.Attributes {
+		if attr.Key == semconv.URLPathKey {
+			return attr.Value.AsString(), true
+		}
+	}
+	return "", false
+}
+
+func matchRoute(rules []string, path string) bool {
+	for _, rule := range rules {
+		if prefix, ok := strings.CutSuffix(rule, "*"); ok {
+			if strings.HasPrefix(path, prefix) {
+				return true
+			}
+		} else if path == rule {
+			return true
+		}
+	}
+	return false
+}
+
+// rateLimitedSampler drops spans the delegate would sample once more than
+// limit per second have been sampled, using a token bucket that holds one
+// second worth of spans, and at least one
+type rateLimitedSampler struct {
+	delegate sdktrace.Sampler
+	limit    float64
+	burst    float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimitedSampler(delegate sdktrace.Sampler, limit float64) *rateLimitedSampler {
+	return &rateLimitedSampler{
+		delegate: delegate,
+		limit:    limit,
+		burst:    max(1, limit),
+		tokens:   max(1, limit),
+		last:     time.Now(),
+	}
+}
+
+func (s *rateLimitedSampler) ShouldSample(p sdktrace.SamplingParameters) sdktrace.SamplingResult {
+	result := s.delegate.ShouldSample(p)
+	if result.Decision != sdktrace.RecordAndSample || s.take() {
+		return result
+	}
+	return sdktrace.SamplingResult{Decision: sdktrace.Drop, Tracestate: result.Tracestate}
+}
+
+func (s *rateLimitedSampler) Description() string {
+	return fmt.Sprintf("RateLimited{%g/s,%s}", s.limit, s.delegate.Description())
+}
+
+// take removes a token from the bucket, reporting false if it is empty
+func (s *rateLimitedSampler) take() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	s.tokens = min(s.burst, s.tokens+now.Sub(s.last).Seconds()*s.limit)
+	s.last = now
+
+	if s.tokens < 1 {
+		return false
+	}
+	s.tokens--
+	return true
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestRouteSamplerFollowsParentForChildSpans(t *testing.T) {
+	sampler, err := newSampler(&Config{
+		TraceSampler:            "parentbased_always_off",
+		TraceAlwaysSampleRoutes: []string{"/make-coffee-honza"},
+		TraceNeverSampleRoutes:  []string{"/readyz"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parent := func(sampled bool) context.Context {
+		config := trace.SpanContextConfig{
+			TraceID: trace.TraceID{1},
+			SpanID:  trace.SpanID{1},
+			Remote:  true,
+		}
+		if sampled {
+			config.TraceFlags = trace.FlagsSampled
+		}
+		return trace.ContextWithSpanContext(context.Background(), trace.NewSpanContext(config))
+	}
+
+	tests := []struct {
+		name   string
+		ctx    context.Context
+		path   string
+		sample bool
+	}{
+		{name: "always rule on a root span", ctx: context.Background(), path: "/make-coffee-honza", sample: true},
+		{name: "never rule on a root span", ctx: context.Background(), path: "/readyz", sample: false},
+		{name: "always rule under an unsampled parent", ctx: parent(false), path: "/make-coffee-honza", sample: false},
+		{name: "never rule under a sampled parent", ctx: parent(true), path: "/readyz", sample: true},
+		{name: "no rule on a root span", ctx: context.Background(), path: "/coffee", sample: false},
+		{name: "no rule under a sampled parent", ctx: parent(true), path: "/coffee", sample: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := sampler.ShouldSample(sdktrace.SamplingParameters{
+				ParentContext: tt.ctx,
+				TraceID:       trace.TraceID{1},
+				Name:          "GET",
+				Kind:          trace.SpanKindServer,
+				Attributes:    []attribute.KeyValue{semconv.URLPath(tt.path)},
+			})
+			if sampled := result.Decision == sdktrace.RecordAndSample; sampled != tt.sample {
+				t.Errorf("sampled = %v, want %v", sampled, tt.sample)
+			}
+		})
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// shutdownPhase is one step of the graceful shutdown
+type shutdownPhase struct {
+	name string
+	run  func(ctx context.Context) error
+}
+
+// serve runs server until it fails or the process receives SIGTERM or SIGINT,
+// and runs startup once the server is listening, so the probes can be served
+// while startup is still in progress. It returns the error the server or
+// startup failed with, or nil after a signal, which also cancels startup.
+func serve(server *http.Server, logger *slog.Logger, startup func(ctx context.Context) error) error {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	defer signal.Stop(signals)
+
+	listener, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		return err
+	}
+
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- server.Serve(listener)
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	startupErr := make(chan error, 1)
+	go func() {
+		startupErr <- startup(ctx)
+	}()
+
+	for {
+		select {
+		case err := <-serverErr:
+			return err
+		case err := <-startupErr:
+			if err != nil {
+				return err
+			}
+			// Startup has finished; keep serving
+			startupErr = nil
+		case sig := <-signals:
+			logger.Info("Shutdown signal received", "signal", sig.String())
+			return nil
+		}
+	}
+}
+
+// drain fails the readiness probe and waits for period, giving the load
+// balancer time to see the failing probe and stop sending new requests before
+// the listener closes
+func drain(health *HealthRegistry, period time.Duration) shutdownPhase {
+	return shutdownPhase{
+		name: "drain",
+		run: func(ctx context.Context) error {
+			health.MarkShuttingDown()
+			select {
+			case <-time.After(period):
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		},
+	}
+}
+
+// shutdown runs the phases in order, logging each one. Every phase runs even if
+// an earlier one failed, so a stuck request still lets the telemetry flush. The
+// drain period is not counted against timeout, which bounds the other phases.
+func shutdown(logger *slog.Logger, drainPhase shutdownPhase, timeout time.Duration, phases ...shutdownPhase) error {
+	runPhase := func(ctx context.Context, phase shutdownPhase) error {
+		start := time.Now()
+		logger.Info("Shutdown phase started", "phase", phase.name)
+		if err := phase.run(ctx); err != nil {
+			logger.Error("Shutdown phase failed", "phase", phase.name, "error", err, "duration", time.Since(start))
+			return err
+		}
+		logger.Info("Shutdown phase completed", "phase", phase.name, "duration", time.Since(start))
+		return nil
+	}
+
+	errs := []error{runPhase(context.Background(), drainPhase)}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	for _, phase := range phases {
+		errs = append(errs, runPhase(ctx, phase))
+	}
+	return errors.Join(errs...)
+}
+
+// closePhase adapts a Close method without an error to a shutdown phase
+func closePhase(name string, close func()) shutdownPhase {
+	return shutdownPhase{
+		name: name,
+		run: func(ctx context.Context) error {
+			close()
+			return nil
+		},
+	}
+}
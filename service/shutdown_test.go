@@ -0,0 +1,23 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"testing"
+)
+
+func TestServeReturnsStartupError(t *testing.T) {
+	server := &http.Server{Addr: "127.0.0.1:0", Handler: http.NotFoundHandler()}
+	defer server.Close()
+
+	migrateErr := errors.New("failed to migrate database schema")
+	err := serve(server, slog.New(slog.NewTextHandler(io.Discard, nil)), func(ctx context.Context) error {
+		return migrateErr
+	})
+	if !errors.Is(err, migrateErr) {
+		t.Fatalf("serve returned %v, want the startup error", err)
+	}
+}
@@ -2,33 +2,30 @@ package main
 
 import (
 	"context"
-	"log"
 
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
 	"go.opentelemetry.io/otel/propagation"
 	"go.opentelemetry.io/otel/sdk/resource"
 	sdktrace "go.opentelemetry.io/otel/sdk/trace"
-	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
 	"go.opentelemetry.io/otel/trace"
 )
 
+// Service metadata shared by the telemetry resource and the runtime metric dimensions
+const (
+	serviceName           = "go-observability-demo"
+	serviceVersion        = "1.0.0"
+	deploymentEnvironment = "prod"
+)
+
 // initTracing initializes OpenTelemetry tracing for distributed tracing and observability.
 // This function sets up the complete tracing infrastructure including resource identification,
 // OTLP exporter configuration, trace provider setup, and global propagators.
 // Returns a tracer instance, cleanup function, and any initialization errors.
-func initTracing() (trace.Tracer, func(), error) {
+func initTracing(config *Config, redactor *Redactor) (trace.Tracer, func(context.Context) error, error) {
 	// Create resource with service metadata for trace identification
-	// The resource provides context about the service generating traces, including
-	// service name, version, and deployment environment. This metadata helps
-	// distinguish traces from different service instances and versions.
-	res, err := resource.New(context.Background(),
-		resource.WithAttributes(
-			semconv.ServiceName("go-observability-demo"), // Identifies this service in traces
-			semconv.ServiceVersion("1.0.0"),              // Version for deployment tracking
-			semconv.DeploymentEnvironment("prod"),        // Environment context (dev/staging/prod)
-		),
-	)
+	res, err := newResource()
 	if err != nil {
 		return nil, nil, err
 	}
@@ -43,15 +40,33 @@ func initTracing() (trace.Tracer, func(), error) {
 		return nil, nil, err
 	}
 
+	// Create the sampler from OTEL_TRACES_SAMPLER and the per-route rules
+	sampler, err := newSampler(config)
+	if err != nil {
+		return nil, nil, err
+	}
+
 	// Create trace provider with batching and sampling configuration
 	// The trace provider manages the lifecycle of traces and controls how they're
 	// processed and exported. Batching improves performance by grouping multiple
 	// spans together, while sampling controls which traces are recorded.
-	tp := sdktrace.NewTracerProvider(
-		sdktrace.WithBatcher(exporter),                // Batch spans for efficient export
-		sdktrace.WithResource(res),                    // Associate service metadata
-		sdktrace.WithSampler(sdktrace.AlwaysSample()), // Record all traces (adjust for production)
-	)
+	// Sensitive span attributes are redacted before spans are batched for export
+	batcher := sdktrace.NewBatchSpanProcessor(exporter)
+
+	options := []sdktrace.TracerProviderOption{
+		sdktrace.WithSpanProcessor(newRedactingSpanProcessor(batcher, redactor)), // Batch spans for efficient export
+		sdktrace.WithResource(res),    // Associate service metadata
+		sdktrace.WithSampler(sampler), // Per-route, parent-based and rate-limited sampling
+	}
+
+	// X-Ray trace IDs start with the epoch seconds of the trace, which lets the
+	// collector forward them to X-Ray unchanged and join them with ALB segments.
+	// Requests that only carry the ALB's Root keep it as their trace ID.
+	if config.XRayTracing {
+		options = append(options, sdktrace.WithIDGenerator(newXRayIDGenerator()))
+	}
+
+	tp := sdktrace.NewTracerProvider(options...)
 
 	// Set global tracer provider for the application
 	// This makes the tracer provider available throughout the application
@@ -62,24 +77,40 @@ func initTracing() (trace.Tracer, func(), error) {
 	// Propagators handle the serialization/deserialization of trace context
 	// across service boundaries (HTTP headers, gRPC metadata, etc.)
 	// TraceContext handles W3C trace context, Baggage handles additional metadata
-	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+	propagators := []propagation.TextMapPropagator{
 		propagation.TraceContext{}, // W3C trace context standard
 		propagation.Baggage{},      // Additional trace metadata
-	))
+	}
+
+	// The X-Ray propagator reads the X-Amzn-Trace-Id header set by the ALB. It
+	// comes first so a W3C traceparent sent by the client still takes precedence.
+	if config.XRayTracing {
+		propagators = append([]propagation.TextMapPropagator{xrayPropagator{}}, propagators...)
+	}
+
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagators...))
 
 	// Get tracer instance for creating spans
 	// The tracer is used throughout the application to create spans,
 	// which represent individual operations within a trace
-	tracer := otel.Tracer("go-observability-demo")
+	tracer := otel.Tracer(serviceName)
 
 	// Cleanup function to properly shutdown tracing infrastructure
 	// This ensures all pending traces are flushed before the application exits
-	// and resources are properly cleaned up
-	cleanup := func() {
-		if err := tp.Shutdown(context.Background()); err != nil {
-			log.Printf("Error shutting down tracer provider: %v", err)
-		}
-	}
+	// and resources are properly cleaned up, within the deadline of ctx
+	return tracer, tp.Shutdown, nil
+}
 
-	return tracer, cleanup, nil
+// newResource creates the resource with service metadata shared by traces and metrics.
+// The resource provides context about the service generating telemetry, including
+// service name, version, and deployment environment. This metadata helps
+// distinguish telemetry from different service instances and versions.
+func newResource() (*resource.Resource, error) {
+	return resource.New(context.Background(),
+		resource.WithAttributes(
+			semconv.ServiceName(serviceName),                     // Identifies this service in traces and metrics
+			semconv.ServiceVersion(serviceVersion),               // Version for deployment tracking
+			semconv.DeploymentEnvironment(deploymentEnvironment), // Environment context (dev/staging/prod)
+		),
+	)
 }
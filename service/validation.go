@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// charsets are the character sets a `charset` validation rule can require
+var charsets = map[string]*regexp.Regexp{
+	// Letters in any script, digits, spaces and the punctuation found in names
+	"name": regexp.MustCompile(`^[\p{L}\p{M}\p{N} .'-]+$`),
+	// Lowercase identifiers such as coffee type names
+	"slug": regexp.MustCompile(`^[a-z0-9_]+$`),
+}
+
+// FieldError is a validation failure of a single request field
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// ValidationErrors lists every invalid field of a request
+type ValidationErrors []FieldError
+
+func (e ValidationErrors) Error() string {
+	messages := make([]string, len(e))
+	for i, fieldErr := range e {
+		messages[i] = fieldErr.Field + ": " + fieldErr.Message
+	}
+	return strings.Join(messages, "; ")
+}
+
+// validate checks the string fields of the struct v against their `validate`
+// tags and returns nil if all of them are valid. Rules are comma-separated:
+//
+//	required      the value is not empty
+//	min=N, max=N  the length in characters is at least or at most N
+//	charset=NAME  every character is in the named charset
+//
+// Fields are reported by their JSON name.
+func validate(v any) error {
+	value := reflect.Indirect(reflect.ValueOf(v))
+	valueType := value.Type()
+
+	var errs ValidationErrors
+	for i := 0; i < valueType.NumField(); i++ {
+		field := valueType.Field(i)
+		tag := field.Tag.Get("validate")
+		if tag == "" || field.Type.Kind() != reflect.String {
+			continue
+		}
+
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "" {
+			name = field.Name
+		}
+
+		if fieldErr, ok := validateField(name, value.Field(i).String(), tag); !ok {
+			errs = append(errs, fieldErr)
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// validateField applies the rules of tag to value, stopping at the first
+// failure. An unknown rule is a programming error and panics.
+func validateField(name string, value string, tag string) (FieldError, bool) {
+	length := utf8.RuneCountInString(value)
+	for _, rule := range strings.Split(tag, ",") {
+		rule, arg, _ := strings.Cut(rule, "=")
+		switch rule {
+		case "required":
+			if value == "" {
+				return FieldError{Field: name, Code: "required", Message: "is required"}, false
+			}
+		case "min":
+			if n := mustAtoi(arg); value != "" && length < n {
+				return FieldError{Field: name, Code: "too_short", Message: fmt.Sprintf("must be at least %d characters", n)}, false
+			}
+		case "max":
+			if n := mustAtoi(arg); length > n {
+				return FieldError{Field: name, Code: "too_long", Message: fmt.Sprintf("must be at most %d characters", n)}, false
+			}
+		case "charset":
+			charset, ok := charsets[arg]
+			if !ok {
+				panic(fmt.Sprintf("validate: unknown charset %q", arg))
+			}
+			if value != "" && !charset.MatchString(value) {
+				return FieldError{Field: name, Code: "invalid_characters", Message: fmt.Sprintf("contains characters outside the %s charset", arg)}, false
+			}
+		default:
+			panic(fmt.Sprintf("validate: unknown rule %q", rule))
+		}
+	}
+	return FieldError{}, true
+}
+
+func mustAtoi(s string) int {
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		panic(fmt.Sprintf("validate: invalid rule argument %q", s))
+	}
+	return n
+}
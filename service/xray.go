@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"strings"
+
+	"go.opentelemetry.io/contrib/propagators/aws/xray"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// xrayHeader is the trace header set by the ALB and X-Ray instrumented clients
+const xrayHeader = "X-Amzn-Trace-Id"
+
+// xrayRootKey holds the trace ID of an X-Amzn-Trace-Id header without a parent
+const xrayRootKey contextKey = "xray_root"
+
+// xrayPropagator extends the X-Ray propagator to headers that only carry a
+// Root, such as "Root=1-5759e988-bd862e3fe1be46a994272793", which the ALB
+// sends when the client did not. The X-Ray propagator ignores them because
+// there is no parent span; this one keeps the Root in the context, so
+// xrayIDGenerator starts the trace under the trace ID the ALB logged.
+type xrayPropagator struct {
+	xray.Propagator
+}
+
+func (p xrayPropagator) Extract(ctx context.Context, carrier propagation.TextMapCarrier) context.Context {
+	extracted := p.Propagator.Extract(ctx, carrier)
+	if trace.SpanContextFromContext(extracted).IsValid() {
+		return extracted
+	}
+	if traceID, ok := parseXRayRoot(carrier.Get(xrayHeader)); ok {
+		return context.WithValue(ctx, xrayRootKey, traceID)
+	}
+	return ctx
+}
+
+// xrayIDGenerator generates X-Ray trace IDs, except for root spans started
+// from a context holding the Root of an X-Amzn-Trace-Id header, which keep
+// that trace ID. Those spans are still roots, so the sampler decides for them
+// as for any new trace.
+type xrayIDGenerator struct {
+	sdktrace.IDGenerator
+}
+
+func newXRayIDGenerator() sdktrace.IDGenerator {
+	return xrayIDGenerator{IDGenerator: xray.NewIDGenerator()}
+}
+
+func (g xrayIDGenerator) NewIDs(ctx context.Context) (trace.TraceID, trace.SpanID) {
+	traceID, spanID := g.IDGenerator.NewIDs(ctx)
+	if root, ok := ctx.Value(xrayRootKey).(trace.TraceID); ok {
+		traceID = root
+	}
+	return traceID, spanID
+}
+
+// parseXRayRoot returns the trace ID of the Root field of an X-Amzn-Trace-Id
+// header. X-Ray trace IDs are "1-{8 hex digit epoch}-{24 hex digits}".
+func parseXRayRoot(header string) (trace.TraceID, bool) {
+	for _, field := range strings.Split(header, ";") {
+		value, ok := strings.CutPrefix(strings.TrimSpace(field), "Root=")
+		if !ok {
+			continue
+		}
+		version, rest, _ := strings.Cut(value, "-")
+		epoch, unique, _ := strings.Cut(rest, "-")
+		if version != "1" || len(epoch) != 8 || len(unique) != 24 {
+			return trace.TraceID{}, false
+		}
+		traceID, err := trace.TraceIDFromHex(epoch + unique)
+		return traceID, err == nil
+	}
+	return trace.TraceID{}, false
+}
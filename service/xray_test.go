@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestXRayRootOnlyHeaderKeepsTraceID(t *testing.T) {
+	tracer := sdktrace.NewTracerProvider(
+		sdktrace.WithIDGenerator(newXRayIDGenerator()),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.AlwaysSample())),
+	).Tracer("test")
+	propagator := propagation.NewCompositeTextMapPropagator(xrayPropagator{}, propagation.TraceContext{})
+
+	tests := []struct {
+		name       string
+		header     string
+		wantParent bool
+	}{
+		// The ALB adds a Root to requests that arrive without a trace header
+		{name: "ALB root only", header: "Root=1-5759e988-bd862e3fe1be46a994272793"},
+		{name: "ALB root with self field", header: "Self=1-67891234-12456789abcdef012345678;Root=1-5759e988-bd862e3fe1be46a994272793"},
+		{name: "root, parent and sampled", header: "Root=1-5759e988-bd862e3fe1be46a994272793;Parent=53995c3f42cd8ad8;Sampled=1", wantParent: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{}
+			header.Set(xrayHeader, tt.header)
+			ctx := propagator.Extract(context.Background(), propagation.HeaderCarrier(header))
+
+			_, span := tracer.Start(ctx, "GET /coffee", trace.WithSpanKind(trace.SpanKindServer))
+			span.End()
+
+			spanContext := span.SpanContext()
+			if got := spanContext.TraceID().String(); got != "5759e988bd862e3fe1be46a994272793" {
+				t.Errorf("trace ID = %s, want the X-Ray Root 5759e988bd862e3fe1be46a994272793", got)
+			}
+			if !spanContext.IsSampled() {
+				t.Error("span was not sampled")
+			}
+			parent := span.(sdktrace.ReadOnlySpan).Parent()
+			if parent.IsValid() != tt.wantParent {
+				t.Errorf("has parent = %v, want %v", parent.IsValid(), tt.wantParent)
+			}
+		})
+	}
+}
+
+func TestXRayIDGeneratorWithoutHeader(t *testing.T) {
+	traceID, spanID := newXRayIDGenerator().NewIDs(context.Background())
+	if !traceID.IsValid() || !spanID.IsValid() {
+		t.Fatalf("invalid IDs %s %s", traceID, spanID)
+	}
+}